@@ -25,7 +25,8 @@ class DisjointSet:
 
 
 def kruskal(edges, num_nodes):
-    edges.sort(key=lambda x: (x[2], x[0], x[1]))  # Sort edges by weight
+    # the same total order as utils.CompareEdges, so ties are broken identically
+    edges.sort(key=lambda x: (x[2], min(x[0], x[1]), max(x[0], x[1])))
     ds = DisjointSet(num_nodes)
     mst = []
 
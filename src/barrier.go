@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// where a parent and its children meet in every phase. The children arrive with
+// their edges and wait for the update of the phase, and the parent waits for all of
+// them before it publishes it. Both are keyed by phase, so a child that arrives at
+// the next phase before the parent is back to waiting is still counted, and a child
+// that waits on an update already published returns straight away. The update of a
+// phase is kept until every child that arrived at it moves on, so a child that the
+// parent stopped waiting for still gets the update of its last phase.
+type PhaseBarrier struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+
+	// the number of children expected at, and the children arrived at, every phase
+	// not published yet
+	expected map[int32]int
+	arrived  map[int32]map[int32]bool
+	// the last phase published, -1 before the first, and the updates of the phases
+	// some child may still ask for
+	published int32
+	updates   map[int32]map[int32]int32
+	// the last phase every child arrived at
+	lastArrived map[int32]int32
+	// the failure the parent gave up with, which ends every wait
+	failure *NodeError
+}
+
+func NewPhaseBarrier() *PhaseBarrier {
+	barrier := &PhaseBarrier{
+		expected:    make(map[int32]int),
+		arrived:     make(map[int32]map[int32]bool),
+		published:   -1,
+		updates:     map[int32]map[int32]int32{-1: {}},
+		lastArrived: make(map[int32]int32),
+	}
+	barrier.cond = sync.NewCond(&barrier.mutex)
+	return barrier
+}
+
+// sets the children to wait for in a phase, before any of them may arrive at it
+func (barrier *PhaseBarrier) Expect(phase int32, children int) {
+	barrier.mutex.Lock()
+	defer barrier.mutex.Unlock()
+
+	barrier.expected[phase] = children
+	barrier.cond.Broadcast()
+}
+
+// counts a child in at the phase, once. Arrivals at a phase already published are
+// late, and not counted.
+func (barrier *PhaseBarrier) Arrive(phase int32, childId int32) {
+	barrier.mutex.Lock()
+	defer barrier.mutex.Unlock()
+
+	if phase <= barrier.published {
+		return
+	}
+	if barrier.arrived[phase] == nil {
+		barrier.arrived[phase] = make(map[int32]bool)
+	}
+	barrier.arrived[phase][childId] = true
+	barrier.lastArrived[childId] = phase
+	barrier.prune()
+	barrier.cond.Broadcast()
+}
+
+// waits for every child expected at the phase to arrive, or for ctx to be done
+func (barrier *PhaseBarrier) WaitArrived(ctx context.Context, phase int32) error {
+	stop := barrier.wakeOnDone(ctx)
+	defer stop()
+
+	barrier.mutex.Lock()
+	defer barrier.mutex.Unlock()
+
+	for len(barrier.arrived[phase]) < barrier.expected[phase] {
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		barrier.cond.Wait()
+	}
+	return nil
+}
+
+// publishes the update of the phase, and wakes the children waiting on it
+func (barrier *PhaseBarrier) Publish(phase int32, update map[int32]int32) {
+	barrier.mutex.Lock()
+	defer barrier.mutex.Unlock()
+
+	barrier.published = phase
+	barrier.updates[phase] = update
+	for p := range barrier.expected {
+		if p <= phase {
+			delete(barrier.expected, p)
+		}
+	}
+	for p := range barrier.arrived {
+		if p <= phase {
+			delete(barrier.arrived, p)
+		}
+	}
+	barrier.prune()
+	barrier.cond.Broadcast()
+}
+
+// waits for the update of the phase to be published, and returns it. If the update
+// of the phase is gone, it returns the last one published instead. It fails with the
+// failure of the parent if it gave up, or the cause of ctx if it is done.
+func (barrier *PhaseBarrier) WaitPublished(ctx context.Context, phase int32) (int32, map[int32]int32, error) {
+	stop := barrier.wakeOnDone(ctx)
+	defer stop()
+
+	barrier.mutex.Lock()
+	defer barrier.mutex.Unlock()
+
+	for barrier.published < phase {
+		if barrier.failure != nil {
+			return 0, nil, barrier.failure
+		}
+		if ctx.Err() != nil {
+			return 0, nil, context.Cause(ctx)
+		}
+		barrier.cond.Wait()
+	}
+	if barrier.failure != nil {
+		return 0, nil, barrier.failure
+	}
+	if update, ok := barrier.updates[phase]; ok {
+		return phase, update, nil
+	}
+	return barrier.published, barrier.updates[barrier.published], nil
+}
+
+// the last phase published and its update
+func (barrier *PhaseBarrier) Published() (int32, map[int32]int32) {
+	barrier.mutex.Lock()
+	defer barrier.mutex.Unlock()
+
+	return barrier.published, barrier.updates[barrier.published]
+}
+
+// the update of a published phase, if it is still kept
+func (barrier *PhaseBarrier) Update(phase int32) (map[int32]int32, bool) {
+	barrier.mutex.Lock()
+	defer barrier.mutex.Unlock()
+
+	if phase > barrier.published {
+		return nil, false
+	}
+	update, ok := barrier.updates[phase]
+	return update, ok
+}
+
+// ends every wait of the children with the failure, now and later
+func (barrier *PhaseBarrier) Abort(nodeErr *NodeError) {
+	barrier.mutex.Lock()
+	defer barrier.mutex.Unlock()
+
+	barrier.failure = nodeErr
+	barrier.cond.Broadcast()
+}
+
+func (barrier *PhaseBarrier) Failure() *NodeError {
+	barrier.mutex.Lock()
+	defer barrier.mutex.Unlock()
+
+	return barrier.failure
+}
+
+func (barrier *PhaseBarrier) String() string {
+	barrier.mutex.Lock()
+	defer barrier.mutex.Unlock()
+
+	return barrier.describe()
+}
+
+// the caller must hold the mutex
+func (barrier *PhaseBarrier) describe() string {
+	phase := barrier.published + 1
+	return fmt.Sprintf("{published: %d, arrived: %d/%d, failed: %t}",
+		barrier.published, len(barrier.arrived[phase]), barrier.expected[phase], barrier.failure != nil)
+}
+
+// drops the updates no child may ask for any more: those of phases before the last
+// published that no child has arrived at since. The caller must hold the mutex.
+func (barrier *PhaseBarrier) prune() {
+	keep := map[int32]bool{barrier.published: true}
+	for _, phase := range barrier.lastArrived {
+		keep[phase] = true
+	}
+	for phase := range barrier.updates {
+		if !keep[phase] {
+			delete(barrier.updates, phase)
+		}
+	}
+}
+
+// wakes the waiters once ctx is done, so they see it
+func (barrier *PhaseBarrier) wakeOnDone(ctx context.Context) func() bool {
+	return context.AfterFunc(ctx, func() {
+		barrier.mutex.Lock()
+		defer barrier.mutex.Unlock()
+
+		barrier.cond.Broadcast()
+	})
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// long enough for a goroutine that is not blocked to get there
+const settle = 100 * time.Millisecond
+
+// the update published in a phase, telling the phase apart
+func phaseUpdate(phase int32) map[int32]int32 {
+	return map[int32]int32{0: phase}
+}
+
+// returns whether done is closed within the wait
+func closedWithin(done <-chan struct{}, wait time.Duration) bool {
+	select {
+	case <-done:
+		return true
+	case <-time.After(wait):
+		return false
+	}
+}
+
+// The phase synchronisation the barrier replaced: the parent waits on a WaitGroup for
+// its children, then broadcasts on a Cond, and each child handler calls Done, then
+// waits on the Cond without a predicate. A broadcast that comes after Done but before
+// the handler waits is lost, and the handler waits for good.
+func TestWaitGroupCondLosesWakeup(t *testing.T) {
+	var childReqWg sync.WaitGroup
+	updateCond := sync.NewCond(&sync.Mutex{})
+
+	// the handler is held between Done and Wait, as the scheduler may do
+	release := make(chan struct{})
+	woken := make(chan struct{})
+	childReqWg.Add(1)
+	go func() {
+		childReqWg.Done()
+		<-release
+		updateCond.L.Lock()
+		updateCond.Wait()
+		updateCond.L.Unlock()
+		close(woken)
+	}()
+
+	// the parent sees every child in, and publishes the update
+	childReqWg.Wait()
+	updateCond.L.Lock()
+	updateCond.Broadcast()
+	updateCond.L.Unlock()
+
+	close(release)
+	if closedWithin(woken, settle) {
+		t.Fatal("expected the handler to miss the broadcast")
+	}
+
+	// let the handler go, so it does not outlive the test
+	for !closedWithin(woken, time.Millisecond) {
+		updateCond.L.Lock()
+		updateCond.Broadcast()
+		updateCond.L.Unlock()
+	}
+}
+
+// the same interleaving over the barrier: the handler checks for the update before it
+// waits, so it finds the one published in the meantime
+func TestPhaseBarrierKeepsWakeup(t *testing.T) {
+	barrier := NewPhaseBarrier()
+	barrier.Expect(0, 1)
+
+	release := make(chan struct{})
+	woken := make(chan struct{})
+	go func() {
+		barrier.Arrive(0, 1)
+		<-release
+		phase, update, err := barrier.WaitPublished(context.Background(), 0)
+		if err != nil || phase != 0 || update[0] != 0 {
+			t.Errorf("got phase %d, update %v, error %v, expected the update of phase 0", phase, update, err)
+		}
+		close(woken)
+	}()
+
+	if err := barrier.WaitArrived(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	barrier.Publish(0, phaseUpdate(0))
+
+	close(release)
+	if !closedWithin(woken, 10*time.Second) {
+		t.Fatal("expected the handler to find the update published before it waited")
+	}
+}
+
+// a child may arrive at the next phase before the parent expects it, and is counted
+func TestPhaseBarrierArriveBeforeExpect(t *testing.T) {
+	barrier := NewPhaseBarrier()
+	barrier.Expect(0, 2)
+	barrier.Arrive(0, 1)
+	barrier.Arrive(0, 2)
+	if err := barrier.WaitArrived(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	barrier.Publish(0, phaseUpdate(0))
+
+	barrier.Arrive(1, 1)
+	barrier.Arrive(1, 2)
+	barrier.Expect(1, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := barrier.WaitArrived(ctx, 1); err != nil {
+		t.Fatalf("expected both children to be counted at phase 1: %v", err)
+	}
+}
+
+func TestPhaseBarrierWaitPublishedAfterPublish(t *testing.T) {
+	barrier := NewPhaseBarrier()
+	barrier.Expect(0, 2)
+	barrier.Arrive(0, 1)
+	barrier.Arrive(0, 2)
+	barrier.Publish(0, phaseUpdate(0))
+
+	// child 2 is done, and the parent goes on with child 1 alone
+	barrier.Expect(1, 1)
+	barrier.Arrive(1, 1)
+	barrier.Publish(1, phaseUpdate(1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// both updates are out by the time the children wait
+	for _, phase := range []int32{1, 0} {
+		got, update, err := barrier.WaitPublished(ctx, phase)
+		if err != nil || got != phase || update[0] != phase {
+			t.Fatalf("got phase %d, update %v, error %v, expected the update of phase %d", got, update, err, phase)
+		}
+	}
+
+	// a repeat of a phase no child is at any more gets the last update, which the
+	// caller rejects
+	barrier.Arrive(2, 1)
+	barrier.Arrive(2, 2)
+	barrier.Publish(2, phaseUpdate(2))
+	if got, _, _ := barrier.WaitPublished(ctx, 0); got != 2 {
+		t.Fatalf("got phase %d, expected the last phase published", got)
+	}
+}
+
+func TestPhaseBarrierAbortAndCancel(t *testing.T) {
+	barrier := NewPhaseBarrier()
+	barrier.Expect(0, 1)
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cause := errors.New("node cancelled")
+	go func() {
+		time.Sleep(settle)
+		cancel(cause)
+	}()
+	if err := barrier.WaitArrived(ctx, 0); !errors.Is(err, cause) {
+		t.Fatalf("got %v, expected the cause of the cancelled context", err)
+	}
+
+	failure := &NodeError{NodeId: 3, Phase: 0, Reason: "over budget"}
+	go func() {
+		time.Sleep(settle)
+		barrier.Abort(failure)
+	}()
+	if _, _, err := barrier.WaitPublished(context.Background(), 0); err != failure {
+		t.Fatalf("got %v, expected the failure of the parent", err)
+	}
+}
+
+// a parent and its children going through many phases, with children arriving at the
+// next phase as soon as they have the update, before the parent expects them, and
+// leaving along the way. Every child must get the update of each phase it arrived at.
+func TestPhaseBarrierStress(t *testing.T) {
+	const (
+		numChildren = 8
+		numPhases   = 200
+	)
+	barrier := NewPhaseBarrier()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// child i leaves after phase lastPhase[i], some of them not at all
+	rng := rand.New(rand.NewSource(1))
+	lastPhase := make([]int32, numChildren)
+	for i := range lastPhase {
+		lastPhase[i] = numPhases - 1
+		if i%2 == 1 {
+			lastPhase[i] = int32(rng.Intn(numPhases))
+		}
+	}
+	present := func(phase int32) int {
+		n := 0
+		for _, last := range lastPhase {
+			if last >= phase {
+				n++
+			}
+		}
+		return n
+	}
+
+	var wg sync.WaitGroup
+	for i := range numChildren {
+		wg.Add(1)
+		go func(childId int32, lastPhase int32) {
+			defer wg.Done()
+			for phase := int32(0); phase <= lastPhase; phase++ {
+				barrier.Arrive(phase, childId)
+				if phase == lastPhase && childId%4 == 1 {
+					// the parent moves on without it, before it waits
+					time.Sleep(time.Millisecond)
+				}
+
+				got, update, err := barrier.WaitPublished(ctx, phase)
+				if err != nil || got != phase || update[0] != phase {
+					t.Errorf("child %d got phase %d, update %v, error %v, expected the update of phase %d", childId, got, update, err, phase)
+					return
+				}
+			}
+		}(int32(i), lastPhase[i])
+	}
+
+	barrier.Expect(0, present(0))
+	for phase := int32(0); phase < numPhases; phase++ {
+		if err := barrier.WaitArrived(ctx, phase); err != nil {
+			t.Fatalf("phase %d: %v", phase, err)
+		}
+		if phase%3 == 0 {
+			// publish first, so the children may arrive at the next phase before
+			// it is expected
+			barrier.Publish(phase, phaseUpdate(phase))
+			barrier.Expect(phase+1, present(phase+1))
+		} else {
+			barrier.Expect(phase+1, present(phase+1))
+			barrier.Publish(phase, phaseUpdate(phase))
+		}
+	}
+	wg.Wait()
+}
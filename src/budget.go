@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	utils "mst/sublinear/utils"
+)
+
+// words taken up by an edge (u, v, weight) and by a fragment id (vertex, fragment)
+const (
+	wordsPerEdge     = 3
+	wordsPerFragment = 2
+)
+
+type BudgetPolicy int
+
+const (
+	// only record the peak memory of a node, to be reported after the run
+	ReportBudget BudgetPolicy = iota
+	// fail with a BudgetExceededError as soon as a node exceeds its budget
+	FailBudget
+	// spill the edges that do not fit within the budget to disk. Fragment ids cannot
+	// be spilled, so a node may still exceed its budget through them alone.
+	SpillBudget
+)
+
+func (policy BudgetPolicy) String() string {
+	switch policy {
+	case FailBudget:
+		return "fail"
+	case SpillBudget:
+		return "spill"
+	}
+	return "report"
+}
+
+func ParseBudgetPolicy(policy string) (BudgetPolicy, error) {
+	switch policy {
+	case "report":
+		return ReportBudget, nil
+	case "fail":
+		return FailBudget, nil
+	case "spill":
+		return SpillBudget, nil
+	}
+	return ReportBudget, fmt.Errorf("unknown budget policy %q, expected report, fail or spill", policy)
+}
+
+// the memory budget of a node, in words
+type NodeBudget struct {
+	words    int
+	policy   BudgetPolicy
+	spillDir string
+}
+
+type BudgetExceededError struct {
+	NodeId int32
+	Words  int
+	Budget int
+}
+
+func (e *BudgetExceededError) Error() string {
+	return fmt.Sprintf("node %d holds %d words, over its budget of %d", e.NodeId, e.Words, e.Budget)
+}
+
+// the words held in memory by the node. The caller must hold both the edges and
+// the fragments mutex, as for the rest of the helpers below.
+func (node *NodeData) words() int {
+	return wordsPerEdge*len(node.edges) + wordsPerFragment*len(node.fragments)
+}
+
+// spills edges if the policy allows it, records the peak memory of the node and
+// checks it against the budget
+func (node *NodeData) enforceBudget() error {
+	if node.budget.policy == SpillBudget {
+		if err := node.spillEdges(); err != nil {
+			return fmt.Errorf("failed to spill edges: %v", err)
+		}
+	}
+
+	words := node.words()
+	node.peakWords = max(node.peakWords, words)
+	if words <= node.budget.words || node.budget.policy != FailBudget {
+		return nil
+	}
+
+	return &BudgetExceededError{NodeId: node.md.id, Words: words, Budget: node.budget.words}
+}
+
+// moves just enough edges to the spill file for the node to fit within its budget
+func (node *NodeData) spillEdges() error {
+	excess := node.words() - node.budget.words
+	if excess <= 0 {
+		return nil
+	}
+	numEdges := min(len(node.edges), (excess+wordsPerEdge-1)/wordsPerEdge)
+	if numEdges == 0 {
+		return nil
+	}
+
+	if node.spillFile == "" {
+		file, err := os.CreateTemp(node.budget.spillDir, fmt.Sprintf("node-%d-*.spill", node.md.id))
+		if err != nil {
+			return err
+		}
+		node.spillFile = file.Name()
+		file.Close()
+	}
+
+	keep := len(node.edges) - numEdges
+	if err := utils.WriteGraph(node.spillFile, node.edges[keep:]); err != nil {
+		return err
+	}
+	node.edges = node.edges[:keep]
+	node.numSpilled += numEdges
+
+	return nil
+}
+
+// all the edges of the node, including those spilled to disk. The spilled edges are
+// back in memory for as long as the caller holds on to them, so they count towards
+// the peak memory of the node.
+func (node *NodeData) loadEdges() ([]*utils.Edge, error) {
+	edges := append([]*utils.Edge{}, node.edges...)
+	if node.numSpilled == 0 {
+		return edges, nil
+	}
+
+	spilled, err := utils.ReadGraph(node.spillFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spilled edges: %v", err)
+	}
+	node.peakWords = max(node.peakWords, node.words()+wordsPerEdge*len(spilled))
+	return append(edges, spilled...), nil
+}
+
+// replaces all the edges of the node, including those spilled to disk
+func (node *NodeData) setEdges(edges []*utils.Edge) error {
+	if err := node.clearSpill(); err != nil {
+		return err
+	}
+	node.edges = edges
+
+	return node.enforceBudget()
+}
+
+func (node *NodeData) clearSpill() error {
+	if node.spillFile == "" {
+		return nil
+	}
+	if err := os.Remove(node.spillFile); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove spill file: %v", err)
+	}
+
+	node.spillFile = ""
+	node.numSpilled = 0
+	return nil
+}
+
+func (node *NodeData) GetEdges() ([]*utils.Edge, error) {
+	node.edgesMutex.Lock()
+	defer node.edgesMutex.Unlock()
+
+	node.fragmentsMutex.Lock()
+	defer node.fragmentsMutex.Unlock()
+
+	return node.loadEdges()
+}
+
+func (node *NodeData) PeakWords() int {
+	node.edgesMutex.Lock()
+	defer node.edgesMutex.Unlock()
+
+	node.fragmentsMutex.Lock()
+	defer node.fragmentsMutex.Unlock()
+
+	return node.peakWords
+}
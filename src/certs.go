@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// how long generated certificates are valid for
+const certValidity = 365 * 24 * time.Hour
+
+// the name of a node in its certificate, both as common name and as dns name, so a
+// child can verify its parent by dialling it under this name
+func nodeName(id int32) string {
+	return fmt.Sprintf("node-%d", id)
+}
+
+func nodeIdFromCert(cert *x509.Certificate) (int32, error) {
+	idStr, ok := strings.CutPrefix(cert.Subject.CommonName, "node-")
+	if !ok {
+		return 0, fmt.Errorf("certificate of %q is not of a node", cert.Subject.CommonName)
+	}
+	id, err := strconv.ParseInt(idStr, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("certificate of %q is not of a node", cert.Subject.CommonName)
+	}
+	return int32(id), nil
+}
+
+func writePem(fileName, blockType string, data []byte, perm os.FileMode) error {
+	return os.WriteFile(fileName, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), perm)
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// writes a fresh CA (ca.pem) to dir, along with a certificate signed by it for each
+// node (node-<id>.pem, node-<id>-key.pem), valid for serving as well as for dialling.
+// The key of the CA is never written: the nodes load their keys from dir, and any of
+// them could sign a certificate of another node with it. More nodes need a new CA.
+func generateCerts(dir string, ids []int32) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "mst cluster ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(certValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return fmt.Errorf("failed to create ca: %v", err)
+	}
+	caCert, err := x509.ParseCertificate(caDer)
+	if err != nil {
+		return err
+	}
+
+	if err := writePem(filepath.Join(dir, "ca.pem"), "CERTIFICATE", caDer, 0644); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		serial, err := newSerial()
+		if err != nil {
+			return err
+		}
+		template := &x509.Certificate{
+			SerialNumber: serial,
+			Subject:      pkix.Name{CommonName: nodeName(id)},
+			DNSNames:     []string{nodeName(id)},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(certValidity),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			return fmt.Errorf("failed to create certificate of node %d: %v", id, err)
+		}
+
+		keyDer, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		if err := writePem(filepath.Join(dir, nodeName(id)+".pem"), "CERTIFICATE", der, 0644); err != nil {
+			return err
+		}
+		if err := writePem(filepath.Join(dir, nodeName(id)+"-key.pem"), "EC PRIVATE KEY", keyDer, 0600); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// the tls config of a node, from the certificates in dir: its own certificate,
+// presented both ways, and the CA it expects of its peers
+func loadNodeTLS(dir string, id int32) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, nodeName(id)+".pem"), filepath.Join(dir, nodeName(id)+"-key.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate of node %d: %v", id, err)
+	}
+
+	caPem, err := os.ReadFile(filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ca: %v", err)
+	}
+	cas := x509.NewCertPool()
+	if !cas.AppendCertsFromPEM(caPem) {
+		return nil, fmt.Errorf("no certificates in ca.pem")
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      cas,
+		ClientCAs:    cas,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS13,
+	}, nil
+}
+
+// client credentials that log failed handshakes. gRPC keeps retrying the parent in
+// the background, and a call would otherwise only time out, without saying why.
+type loggedCreds struct {
+	credentials.TransportCredentials
+	parentId int32
+}
+
+func (c *loggedCreds) ClientHandshake(ctx context.Context, authority string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	conn, authInfo, err := c.TransportCredentials.ClientHandshake(ctx, authority, rawConn)
+	if err != nil {
+		log.Printf("[WARN] tls handshake with parent %d failed: %v", c.parentId, err)
+	}
+	return conn, authInfo, err
+}
+
+func (c *loggedCreds) Clone() credentials.TransportCredentials {
+	return &loggedCreds{TransportCredentials: c.TransportCredentials.Clone(), parentId: c.parentId}
+}
+
+// checks that the child a message claims to come from is the one its certificate
+// was issued to
+func verifyPeer(ctx context.Context, srcId int32) error {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return status.Errorf(codes.Unauthenticated, "no peer")
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return status.Errorf(codes.Unauthenticated, "no verified certificate")
+	}
+
+	id, err := nodeIdFromCert(tlsInfo.State.VerifiedChains[0][0])
+	if err != nil {
+		return status.Errorf(codes.PermissionDenied, "%v", err)
+	}
+	if id != srcId {
+		return status.Errorf(codes.PermissionDenied, "message from node %d over the certificate of node %d", srcId, id)
+	}
+
+	return nil
+}
+
+// the messages children send, all of which carry their id
+type fromChild interface {
+	GetSrcId() int32
+}
+
+func verifyPeerUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if msg, ok := req.(fromChild); ok {
+		if err := verifyPeer(ctx, msg.GetSrcId()); err != nil {
+			return nil, err
+		}
+	}
+	return handler(ctx, req)
+}
+
+// a stream that checks the sender of every message it receives
+type verifiedStream struct {
+	grpc.ServerStream
+}
+
+func (stream *verifiedStream) RecvMsg(m any) error {
+	if err := stream.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if msg, ok := m.(fromChild); ok {
+		return verifyPeer(stream.Context(), msg.GetSrcId())
+	}
+	return nil
+}
+
+func verifyPeerStream(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &verifiedStream{ServerStream: stream})
+}
+
+func certsMain(args []string) {
+	fs := flag.NewFlagSet("certs", flag.ExitOnError)
+	dir := fs.String("dir", "certs", "directory to write the ca and the node certificates to")
+	manifestFile := fs.String("manifest", "", "cluster manifest to take the node ids from")
+	numNodes := fs.Int("nodes", 0, "number of nodes, with ids 0 to nodes-1, if there is no manifest")
+	_ = fs.Parse(args)
+
+	ids := []int32{}
+	if *manifestFile != "" {
+		manifest, err := ReadManifest(*manifestFile)
+		if err != nil {
+			log.Fatalf("[ERROR] failed to read manifest: %v", err)
+		}
+		for _, node := range manifest.Nodes {
+			ids = append(ids, node.Id)
+		}
+	} else {
+		for id := 0; id < *numNodes; id++ {
+			ids = append(ids, int32(id))
+		}
+	}
+	if len(ids) == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	if err := generateCerts(*dir, ids); err != nil {
+		log.Fatalf("[ERROR] failed to generate certificates: %v", err)
+	}
+	log.Printf("===> wrote a ca and certificates for %d nodes to %s", len(ids), *dir)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	comms "mst/sublinear/comms"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// writes certificates for nodes 0 to n-1, checking that the key of the CA is not
+// left next to them
+func writeTestCerts(t *testing.T, n int) string {
+	dir := t.TempDir()
+	ids := []int32{}
+	for id := range n {
+		ids = append(ids, int32(id))
+	}
+	if err := generateCerts(dir, ids); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1+2*n {
+		t.Fatalf("got %v, expected the ca and a certificate and key per node", files)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ca-key.pem")); err == nil {
+		t.Fatal("expected the key of the ca to be thrown away")
+	}
+	return dir
+}
+
+// a run over localhost, with every node talking over mutual TLS
+func TestCalcMSTCerts(t *testing.T) {
+	graphFile := writeRandomGraph(t, 30, 120, 3)
+	certsDir := writeTestCerts(t, 64)
+
+	outFile, err := runFlags(t, graphFile, "-transport", "grpc", "-budget-policy", "report", "-certs", certsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkForest(graphFile, outFile); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// a child may only send as the node its certificate was issued to
+func TestCertsRejectOtherNode(t *testing.T) {
+	certsDir := writeTestCerts(t, 4)
+	cfg := TransportConfig{maxMessageWords: 1000, certsDir: certsDir}
+
+	listen := func() net.Listener {
+		lis, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return lis
+	}
+	transport := func(md *NodeMetaData) Transport {
+		tlsConfig, err := cfg.nodeTLS(md.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewGrpcTransport(md.lis, cfg, tlsConfig)
+	}
+
+	parentMd := NewNodeMetaData(1, listen())
+	childMd := NewNodeMetaData(2, listen())
+	parentMd.SetChildren([]*NodeMetaData{childMd})
+	childMd.SetParent(parentMd)
+
+	parent, err := NewSubLinearServer(context.Background(), NewNodeData(parentMd, &NodeBudget{words: 1000}),
+		ServerConfig{maxMessageWords: 1000, jobId: "job"}, transport(parentMd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer parent.ShutDown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	chunk := func(srcId int32) *comms.Edges {
+		return &comms.Edges{SrcId: srcId, NumChunks: 2, JobId: "job", Edges: []*comms.EdgeData{{U: 1, V: 2, Weight: 5}}}
+	}
+
+	// node 3 holds a certificate, but not the one of the child it claims to be
+	impostorMd := NewNodeMetaData(3, listen())
+	impostor := transport(impostorMd)
+	defer impostor.Stop()
+	if _, err := impostor.SendUp(ctx, parentMd, chunk(childMd.id)); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("got %v, expected the parent to turn down a message over the certificate of another node", err)
+	}
+
+	child := transport(childMd)
+	defer child.Stop()
+	if _, err := child.SendUp(ctx, parentMd, chunk(childMd.id)); err != nil {
+		t.Fatalf("expected the parent to take the message of the child: %v", err)
+	}
+
+	edges, err := parent.nodeData.GetEdges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(edges) != 1 {
+		t.Fatalf("parent holds %d edges, expected only those of the child", len(edges))
+	}
+}
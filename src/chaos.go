@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	utils "mst/sublinear/utils"
+)
+
+// the minimum spanning forest of the whole graph, worked out on a single machine.
+// Edges are in a total order, so it is the only one.
+func referenceForest(edges []*utils.Edge) []*utils.Edge {
+	sorted := append([]*utils.Edge{}, edges...)
+	utils.SortEdges(sorted)
+
+	ds := utils.NewDisjointSet()
+	forest := []*utils.Edge{}
+	for _, edge := range sorted {
+		if ds.Union(edge.U, edge.V) {
+			forest = append(forest, edge)
+		}
+	}
+	return forest
+}
+
+// checks the forest written by a run against the reference one, edge for edge
+func checkForest(graphFile, forestFile string) error {
+	graph, err := utils.ReadGraph(graphFile)
+	if err != nil {
+		return fmt.Errorf("failed to read input graph: %v", err)
+	}
+	forest, _, err := utils.ReadForest(forestFile)
+	if err != nil {
+		return fmt.Errorf("failed to read output forest: %v", err)
+	}
+
+	// edges are keyed by their endpoints, either way round
+	key := func(edge *utils.Edge) [3]int32 {
+		return [3]int32{min(edge.U, edge.V), max(edge.U, edge.V), edge.Weight}
+	}
+	want := make(map[[3]int32]bool)
+	for _, edge := range referenceForest(graph) {
+		want[key(edge)] = true
+	}
+
+	extra := 0
+	for _, edge := range forest {
+		if !want[key(edge)] {
+			extra++
+			continue
+		}
+		delete(want, key(edge))
+	}
+	if extra > 0 || len(want) > 0 {
+		return fmt.Errorf("%d edges of the forest are not in the minimum spanning forest, and %d of it are missing", extra, len(want))
+	}
+	return nil
+}
+
+// runs a graph with faults injected as a policy says, then checks that the forest
+// still is the minimum spanning forest
+func chaosMain(args []string) {
+	fs := flag.NewFlagSet("chaos", flag.ExitOnError)
+	buildConfig := addRunFlags(fs)
+	fs.Usage = func() {
+		fmt.Println("usage: go run *.go chaos -faults <policy> [flags] <infile> <outfile> <alpha>")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	infile, outfile, alpha := parseRunArgs(fs)
+	cfg, err := buildConfig(alpha)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	if cfg.faults == nil {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	if err := calcMST(infile, outfile, cfg); err != nil {
+		log.Fatalf("[ERROR] chaos run failed: %v", err)
+	}
+	stats(infile, outfile)
+
+	if err := checkForest(infile, outfile); err != nil {
+		log.Fatalf("[ERROR] chaos run gave the wrong forest: %v", err)
+	}
+	log.Printf("===> chaos run gave the minimum spanning forest, despite the faults in %s", cfg.faultsFile)
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	utils "mst/sublinear/utils"
+)
+
+// the state of a node at the start of a phase, as written by the node itself. A
+// node that is done writes one last checkpoint for the phase after its last.
+type NodeCheckpoint struct {
+	Id       int32   `json:"id"`
+	Parent   int32   `json:"parent"` // -1 for the root
+	Phase    int32   `json:"phase"`
+	Done     bool    `json:"done"`
+	Children []int32 `json:"children"`
+	// edges as (u, v, weight), and the fragment of every vertex on them
+	Edges     [][3]int32      `json:"edges"`
+	Fragments map[int32]int32 `json:"fragments"`
+	// the bytes of the forest the root had written by then
+	OutFileBytes int64 `json:"outFileBytes,omitempty"`
+}
+
+var checkpointPattern = regexp.MustCompile(`^node-(\d+)-phase-(\d+)\.json$`)
+
+func checkpointFile(dir string, id, phase int32) string {
+	return filepath.Join(dir, fmt.Sprintf("node-%d-phase-%d.json", id, phase))
+}
+
+// the state of a node, taken while nothing else changes it
+func newCheckpoint(node *NodeData, phase int32, done bool) (*NodeCheckpoint, error) {
+	edges, err := node.GetEdges()
+	if err != nil {
+		return nil, err
+	}
+
+	node.md.stateMutex.Lock()
+	cp := &NodeCheckpoint{Id: node.md.id, Parent: -1, Phase: phase, Done: done, Children: []int32{}}
+	if node.md.parent != nil {
+		cp.Parent = node.md.parent.id
+	}
+	for _, child := range node.md.children {
+		cp.Children = append(cp.Children, child.id)
+	}
+	node.md.stateMutex.Unlock()
+
+	cp.Edges = make([][3]int32, 0, len(edges))
+	for _, edge := range edges {
+		cp.Edges = append(cp.Edges, [3]int32{edge.U, edge.V, edge.Weight})
+	}
+
+	node.fragmentsMutex.Lock()
+	cp.Fragments = make(map[int32]int32, len(node.fragments))
+	for vertex, fragment := range node.fragments {
+		cp.Fragments[vertex] = fragment
+	}
+	node.fragmentsMutex.Unlock()
+
+	return cp, nil
+}
+
+// writes the checkpoint, and drops those of the node older than the phase before.
+// Nodes are at most a phase apart, so every node still has one of the last phase
+// they all started.
+func writeCheckpoint(dir string, cp *NodeCheckpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	// a crash mid write leaves the last checkpoint as it was
+	fileName := checkpointFile(dir, cp.Id, cp.Phase)
+	if err := os.WriteFile(fileName+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %v", err)
+	}
+	if err := os.Rename(fileName+".tmp", fileName); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %v", err)
+	}
+
+	if cp.Phase >= 2 {
+		if err := os.Remove(checkpointFile(dir, cp.Id, cp.Phase-2)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove old checkpoint: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func readCheckpoint(fileName string) (*NodeCheckpoint, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	cp := &NodeCheckpoint{}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint %s: %v", fileName, err)
+	}
+	return cp, nil
+}
+
+// the phases of the checkpoints in dir, by node
+func listCheckpoints(dir string) (map[int32][]int32, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list checkpoints: %v", err)
+	}
+
+	phases := make(map[int32][]int32)
+	for _, entry := range entries {
+		match := checkpointPattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+		id, _ := strconv.ParseInt(match[1], 10, 32)
+		phase, _ := strconv.ParseInt(match[2], 10, 32)
+		phases[int32(id)] = append(phases[int32(id)], int32(phase))
+	}
+
+	return phases, nil
+}
+
+// removes the checkpoints of an earlier run
+func clearCheckpoints(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create checkpoint dir: %v", err)
+	}
+
+	phases, err := listCheckpoints(dir)
+	if err != nil {
+		return err
+	}
+	for id, nodePhases := range phases {
+		for _, phase := range nodePhases {
+			if err := os.Remove(checkpointFile(dir, id, phase)); err != nil {
+				return fmt.Errorf("failed to remove checkpoint: %v", err)
+			}
+		}
+	}
+
+	// along with any that were cut off mid write
+	partial, err := filepath.Glob(filepath.Join(dir, "node-*-phase-*.json.tmp"))
+	if err != nil {
+		return err
+	}
+	for _, fileName := range partial {
+		if err := os.Remove(fileName); err != nil {
+			return fmt.Errorf("failed to remove checkpoint: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// the checkpoint of a node for the phase, or the last one before it if the node was
+// done by then
+func loadCheckpoint(dir string, id, phase int32, phases []int32) (*NodeCheckpoint, error) {
+	best := int32(-1)
+	for _, p := range phases {
+		if p <= phase && p > best {
+			best = p
+		}
+	}
+	if best < 0 {
+		return nil, fmt.Errorf("no checkpoint of node %d for phase %d", id, phase)
+	}
+
+	cp, err := readCheckpoint(checkpointFile(dir, id, best))
+	if err != nil {
+		return nil, err
+	}
+	if best != phase && !cp.Done {
+		return nil, fmt.Errorf("no checkpoint of node %d for phase %d, the last is of phase %d", id, phase, best)
+	}
+	return cp, nil
+}
+
+// the last checkpoint of a node up to the phase
+func lastCheckpoint(dir string, id, phase int32) (*NodeCheckpoint, error) {
+	phases, err := listCheckpoints(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	last := int32(-1)
+	for _, p := range phases[id] {
+		if p <= phase {
+			last = max(last, p)
+		}
+	}
+	if last < 0 {
+		return nil, fmt.Errorf("no checkpoint of node %d up to phase %d", id, phase)
+	}
+	return readCheckpoint(checkpointFile(dir, id, last))
+}
+
+// the last phase that every node still running started, and the checkpoint of every
+// node for it
+func resumePoint(dir string) (int32, map[int32]*NodeCheckpoint, error) {
+	phases, err := listCheckpoints(dir)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(phases) == 0 {
+		return 0, nil, fmt.Errorf("no checkpoints in %s", dir)
+	}
+
+	phase := int32(-1)
+	for id, nodePhases := range phases {
+		last := nodePhases[0]
+		for _, p := range nodePhases {
+			last = max(last, p)
+		}
+		cp, err := readCheckpoint(checkpointFile(dir, id, last))
+		if err != nil {
+			return 0, nil, err
+		}
+		if cp.Done {
+			continue
+		}
+		if phase < 0 || last < phase {
+			phase = last
+		}
+	}
+	if phase < 0 {
+		return 0, nil, fmt.Errorf("every node in %s is done already", dir)
+	}
+
+	checkpoints := make(map[int32]*NodeCheckpoint, len(phases))
+	for id, nodePhases := range phases {
+		cp, err := loadCheckpoint(dir, id, phase, nodePhases)
+		if err != nil {
+			return 0, nil, err
+		}
+		checkpoints[id] = cp
+	}
+
+	return phase, checkpoints, nil
+}
+
+// puts a node of a freshly built tree back in the state of its checkpoint
+func restoreNode(node *NodeData, cp *NodeCheckpoint) error {
+	parent := int32(-1)
+	if node.md.parent != nil {
+		parent = node.md.parent.id
+	}
+	if cp.Id != node.md.id || cp.Parent != parent {
+		return fmt.Errorf("checkpoint of node %d (parent %d) does not match node %d (parent %d) of the tree",
+			cp.Id, cp.Parent, node.md.id, parent)
+	}
+
+	// children that were done by the phase are left out
+	remaining := make(map[int32]bool, len(cp.Children))
+	for _, id := range cp.Children {
+		remaining[id] = true
+	}
+	for _, child := range append([]*NodeMetaData{}, node.md.children...) {
+		if !remaining[child.id] {
+			node.md.RemoveChild(child.id)
+		}
+	}
+
+	node.md.stateMutex.Lock()
+	node.md.phase = cp.Phase
+	node.md.stateMutex.Unlock()
+	// the update of the phase before is out, so the children send the edges of this one
+	node.setUpdate(cp.Phase-1, make(map[int32]int32))
+
+	edges := make([]*utils.Edge, 0, len(cp.Edges))
+	for _, edge := range cp.Edges {
+		edges = append(edges, &utils.Edge{U: edge[0], V: edge[1], Weight: edge[2]})
+	}
+	if err := node.ClearEdges(); err != nil {
+		return err
+	}
+	node.ClearFragments()
+	if err := node.AddEdges(edges); err != nil {
+		return fmt.Errorf("failed to restore edges: %v", err)
+	}
+	if err := node.UpdateFragments(cp.Fragments); err != nil {
+		return fmt.Errorf("failed to restore fragments: %v", err)
+	}
+
+	return nil
+}
+
+// cuts the forest written so far back to what the root had written by the phase
+func restoreOutput(outFile string, cp *NodeCheckpoint) error {
+	if err := os.Remove(outFile); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove old out file: %v", err)
+	}
+
+	info, err := os.Stat(partialFile(outFile))
+	if err != nil {
+		return fmt.Errorf("failed to find the partial out file to resume: %v", err)
+	}
+	if info.Size() < cp.OutFileBytes {
+		return fmt.Errorf("partial out file has %d bytes, but the root had written %d by phase %d",
+			info.Size(), cp.OutFileBytes, cp.Phase)
+	}
+
+	return os.Truncate(partialFile(outFile), cp.OutFileBytes)
+}
+
+// starts the output of a run, or puts the tree and its output back in the state of
+// the checkpoints to resume from. Returns the nodes that were done by then.
+func prepareRun(tree *Tree, outFile string, cfg *RunConfig) (map[int32]bool, error) {
+	done := make(map[int32]bool)
+	if !cfg.resume {
+		if cfg.checkpointDir != "" {
+			if err := clearCheckpoints(cfg.checkpointDir); err != nil {
+				return nil, err
+			}
+		}
+		return done, startOutput(outFile)
+	}
+
+	phase, checkpoints, err := resumePoint(cfg.checkpointDir)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("resume    : from phase %d", phase)
+
+	for _, node := range tree.nodes {
+		cp, ok := checkpoints[node.md.id]
+		if !ok {
+			return nil, fmt.Errorf("no checkpoint of node %d", node.md.id)
+		}
+		if cp.Done {
+			done[node.md.id] = true
+			continue
+		}
+		if err := restoreNode(node, cp); err != nil {
+			return nil, err
+		}
+		if node.md.isRoot() {
+			if err := restoreOutput(outFile, cp); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return done, nil
+}
+
+// the forest written by a failed run is kept along with the checkpoints, to resume
+// from, or discarded if there are none
+func abandonOutput(outFile, checkpointDir string) {
+	if checkpointDir == "" {
+		discardOutput(outFile)
+		return
+	}
+	log.Printf("[INFO] kept %s and the checkpoints in %s, to resume from", partialFile(outFile), checkpointDir)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	utils "mst/sublinear/utils"
+)
+
+// checks that a forest holds no edge twice
+func checkNoDuplicates(t *testing.T, forestFile string, forest []*utils.Edge) int {
+	t.Helper()
+	seen := make(map[[3]int32]bool)
+	for _, edge := range forest {
+		key := [3]int32{min(edge.U, edge.V), max(edge.U, edge.V), edge.Weight}
+		if seen[key] {
+			t.Fatalf("edge %d %d %d is in %s twice", edge.U, edge.V, edge.Weight, forestFile)
+		}
+		seen[key] = true
+	}
+	return len(forest)
+}
+
+// a leaf crashes, its parent declares it dead and the run fails, and the run resumed
+// from the checkpoints gives the same forest as one that never failed
+func TestCrashAndResume(t *testing.T) {
+	graphFile := writeRandomGraph(t, 60, 400, 5)
+	outFile := filepath.Join(t.TempDir(), "out.txt")
+	args := []string{
+		"-transport", "channel", "-budget-policy", "report", "-checkpoint-dir", filepath.Join(t.TempDir(), "checkpoints"),
+		"-heartbeat", "20ms", "-dead-after", "500ms",
+	}
+
+	err := runFlagsTo(t, graphFile, outFile, append(args, "-crash", "1:2")...)
+	if err == nil || !strings.Contains(err.Error(), "node 1 failed in phase 2: declared dead") {
+		t.Fatalf("got %v, expected the crashed leaf to be declared dead", err)
+	}
+	if _, err := os.Stat(outFile); err == nil {
+		t.Fatal("expected no forest out of a failed run")
+	}
+	partial, err := utils.ReadGraph(partialFile(outFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := checkNoDuplicates(t, partialFile(outFile), partial)
+
+	// as if the root had written the edges of a phase after its last checkpoint, and
+	// died before the next, which the resumed run cuts away before it writes them again
+	data, err := os.ReadFile(partialFile(outFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(partialFile(outFile), append(data, data...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runFlagsTo(t, graphFile, outFile, append(args, "-resume")...); err != nil {
+		t.Fatalf("resumed run failed: %v", err)
+	}
+	forest, _, err := utils.ReadForest(outFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total := checkNoDuplicates(t, outFile, forest); total < written {
+		t.Fatalf("got %d edges in the forest, fewer than the %d written before the crash", total, written)
+	}
+	if err := checkForest(graphFile, outFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(partialFile(outFile)); err == nil {
+		t.Fatal("expected the partial forest to be moved to the output")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"hash/crc32"
+	"strconv"
+
+	comms "mst/sublinear/comms"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// the metadata key of the checksum of the edges a child sends up
+const checksumKey = "edges-crc32"
+
+// the checksum of a message, over its deterministic encoding, so that both ends
+// agree on it whatever the order of its maps
+func edgesChecksum(edges *comms.Edges) (uint32, error) {
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(edges)
+	if err != nil {
+		return 0, err
+	}
+	return crc32.ChecksumIEEE(data), nil
+}
+
+// sends the checksum of the edges along with them, worked out before anything else
+// touches the message
+func checksumUnaryClient(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if edges, ok := req.(*comms.Edges); ok && method == comms.EdgeDataService_PropogateUp_FullMethodName {
+		sum, err := edgesChecksum(edges)
+		if err != nil {
+			return err
+		}
+		ctx = metadata.AppendToOutgoingContext(ctx, checksumKey, strconv.FormatUint(uint64(sum), 10))
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// turns down edges that do not match the checksum they were sent with, as the
+// handler would see them. The child sends them again, as it would after a broken
+// connection. Edges sent without a checksum are taken as they are.
+func verifyChecksumUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	edges, ok := req.(*comms.Edges)
+	if !ok || info.FullMethod != comms.EdgeDataService_PropogateUp_FullMethodName {
+		return handler(ctx, req)
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	sums := md.Get(checksumKey)
+	if len(sums) == 0 {
+		return handler(ctx, req)
+	}
+	expected, err := strconv.ParseUint(sums[0], 10, 32)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid checksum %q: %v", sums[0], err)
+	}
+
+	sum, err := edgesChecksum(edges)
+	if err != nil {
+		return nil, err
+	}
+	if sum != uint32(expected) {
+		return nil, status.Errorf(codes.DataLoss, "chunk %d of phase %d from child %d does not match its checksum",
+			edges.GetChunk(), edges.GetPhase(), edges.GetSrcId())
+	}
+	return handler(ctx, req)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	comms "mst/sublinear/comms"
+)
+
+// an upper bound on the bytes taken up by a word on the wire (a tagged varint of a
+// negative int32 takes 11, plus the framing of its edge or map entry), and by the
+// fields around them
+const (
+	bytesPerWord         = 12
+	messageOverheadBytes = 1024
+)
+
+// the largest message in bytes that holds at most maxWords words
+func maxMessageBytes(maxWords int) int {
+	return maxWords*bytesPerWord + messageOverheadBytes
+}
+
+// the number of words in an update
+func updateWords(update *comms.Update) int {
+	return wordsPerFragment * len(update.GetUpdates())
+}
+
+type MessageTooLargeError struct {
+	Words    int
+	MaxWords int
+}
+
+func (e *MessageTooLargeError) Error() string {
+	return fmt.Sprintf("message of %d words, over the cap of %d", e.Words, e.MaxWords)
+}
+
+// splits the edges sent up by a child into chunks of at most maxWords words. The
+// fragment id of a vertex goes along with the first edge that needs it.
+func chunkEdges(req *comms.Edges, maxWords int) ([]*comms.Edges, error) {
+	newChunk := func() *comms.Edges {
+		return &comms.Edges{
+			SrcId:         req.GetSrcId(),
+			NoMoreUpdates: req.GetNoMoreUpdates(),
+			Phase:         req.GetPhase(),
+			AcceptsPacked: req.GetAcceptsPacked(),
+			JobId:         req.GetJobId(),
+			FragmentIds:   make(map[int32]int32),
+		}
+	}
+
+	fragmentIds := req.GetFragmentIds()
+	sent := make(map[int32]bool)
+	chunks := []*comms.Edges{}
+	chunk := newChunk()
+	add := func(words int) error {
+		if words > maxWords {
+			return &MessageTooLargeError{Words: words, MaxWords: maxWords}
+		}
+		if numWords(chunk)+words > maxWords {
+			chunks = append(chunks, chunk)
+			chunk = newChunk()
+		}
+		return nil
+	}
+
+	for _, edge := range req.GetEdges() {
+		vertices := []int32{}
+		for _, vertex := range []int32{edge.GetU(), edge.GetV()} {
+			if _, ok := fragmentIds[vertex]; ok && !sent[vertex] && !slices.Contains(vertices, vertex) {
+				vertices = append(vertices, vertex)
+			}
+		}
+
+		if err := add(wordsPerEdge + wordsPerFragment*len(vertices)); err != nil {
+			return nil, err
+		}
+		chunk.Edges = append(chunk.Edges, edge)
+		for _, vertex := range vertices {
+			chunk.FragmentIds[vertex] = fragmentIds[vertex]
+			sent[vertex] = true
+		}
+	}
+
+	// fragment ids that no edge needed, in the order of their vertices
+	vertices := []int32{}
+	for vertex := range fragmentIds {
+		if !sent[vertex] {
+			vertices = append(vertices, vertex)
+		}
+	}
+	slices.Sort(vertices)
+	for _, vertex := range vertices {
+		if err := add(wordsPerFragment); err != nil {
+			return nil, err
+		}
+		chunk.FragmentIds[vertex] = fragmentIds[vertex]
+	}
+
+	chunks = append(chunks, chunk)
+	for i, chunk := range chunks {
+		chunk.Chunk = int32(i)
+		chunk.NumChunks = int32(len(chunks))
+	}
+
+	return chunks, nil
+}
+
+// chunk i of the update of a phase, with at most maxWords words in every chunk
+func chunkUpdate(update map[int32]int32, phase int32, i int32, maxWords int) (*comms.Update, error) {
+	perChunk := maxWords / wordsPerFragment
+	if perChunk == 0 {
+		return nil, &MessageTooLargeError{Words: wordsPerFragment, MaxWords: maxWords}
+	}
+	numChunks := max(1, (len(update)+perChunk-1)/perChunk)
+	if i < 0 || int(i) >= numChunks {
+		return nil, fmt.Errorf("no chunk %d of an update in %d chunks", i, numChunks)
+	}
+
+	// every chunk is cut from the same order of the fragments
+	fragments := make([]int32, 0, len(update))
+	for fragment := range update {
+		fragments = append(fragments, fragment)
+	}
+	slices.Sort(fragments)
+	fragments = fragments[int(i)*perChunk : min(len(fragments), int(i+1)*perChunk)]
+
+	chunk := &comms.Update{
+		Updates:   make(map[int32]int32, len(fragments)),
+		Phase:     phase,
+		Chunk:     i,
+		NumChunks: int32(numChunks),
+	}
+	for _, fragment := range fragments {
+		chunk.Updates[fragment] = update[fragment]
+	}
+
+	return chunk, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+
+	comms "mst/sublinear/comms"
+)
+
+// edges sent up by a child, with the fragment ids of their endpoints and of a few
+// vertices no edge needs
+func randomEdgesMessage(numEdges int, seed int64) *comms.Edges {
+	rng := rand.New(rand.NewSource(seed))
+	req := &comms.Edges{
+		SrcId:         4,
+		Phase:         2,
+		NoMoreUpdates: true,
+		JobId:         "job",
+		FragmentIds:   make(map[int32]int32),
+	}
+	for range numEdges {
+		u, v := rng.Int31n(30), rng.Int31n(30)
+		req.Edges = append(req.Edges, &comms.EdgeData{U: u, V: v, Weight: rng.Int31n(100) - 50})
+		req.FragmentIds[u] = rng.Int31n(10)
+		req.FragmentIds[v] = rng.Int31n(10)
+	}
+	for vertex := int32(100); vertex < 105; vertex++ {
+		req.FragmentIds[vertex] = vertex
+	}
+	return req
+}
+
+func TestChunkEdgesRoundTrip(t *testing.T) {
+	req := randomEdgesMessage(40, 1)
+
+	for _, maxWords := range []int{7, 10, 33, 1000} {
+		chunks, err := chunkEdges(req, maxWords)
+		if err != nil {
+			t.Fatalf("cap %d: %v", maxWords, err)
+		}
+		if maxWords == 1000 && len(chunks) != 1 {
+			t.Fatalf("cap %d: got %d chunks, expected a message under the cap to go whole", maxWords, len(chunks))
+		}
+
+		edges := []*comms.EdgeData{}
+		fragmentIds := make(map[int32]int32)
+		for i, chunk := range chunks {
+			if words := numWords(chunk); words > maxWords {
+				t.Fatalf("cap %d: chunk %d holds %d words", maxWords, i, words)
+			}
+			if chunk.GetChunk() != int32(i) || chunk.GetNumChunks() != int32(len(chunks)) {
+				t.Fatalf("cap %d: chunk %d is numbered %d of %d", maxWords, i, chunk.GetChunk(), chunk.GetNumChunks())
+			}
+			if chunk.GetSrcId() != req.GetSrcId() || chunk.GetPhase() != req.GetPhase() ||
+				chunk.GetJobId() != req.GetJobId() || chunk.GetNoMoreUpdates() != req.GetNoMoreUpdates() {
+				t.Fatalf("cap %d: chunk %d does not carry the fields of the message", maxWords, i)
+			}
+
+			edges = append(edges, chunk.GetEdges()...)
+			for vertex, id := range chunk.GetFragmentIds() {
+				if _, ok := fragmentIds[vertex]; ok {
+					t.Fatalf("cap %d: the fragment id of vertex %d is sent twice", maxWords, vertex)
+				}
+				fragmentIds[vertex] = id
+			}
+		}
+
+		if len(edges) != len(req.GetEdges()) {
+			t.Fatalf("cap %d: got %d edges back, expected %d", maxWords, len(edges), len(req.GetEdges()))
+		}
+		for i, edge := range edges {
+			if edge != req.GetEdges()[i] {
+				t.Fatalf("cap %d: edge %d is out of order", maxWords, i)
+			}
+		}
+		if len(fragmentIds) != len(req.GetFragmentIds()) {
+			t.Fatalf("cap %d: got %d fragment ids back, expected %d", maxWords, len(fragmentIds), len(req.GetFragmentIds()))
+		}
+		for vertex, id := range req.GetFragmentIds() {
+			if fragmentIds[vertex] != id {
+				t.Fatalf("cap %d: vertex %d came back in fragment %d, expected %d", maxWords, vertex, fragmentIds[vertex], id)
+			}
+		}
+	}
+}
+
+func TestChunkEdgesTooSmall(t *testing.T) {
+	// an edge and the fragment ids of its endpoints take 7 words
+	req := &comms.Edges{
+		Edges:       []*comms.EdgeData{{U: 1, V: 2, Weight: 3}},
+		FragmentIds: map[int32]int32{1: 1, 2: 2},
+	}
+
+	for _, maxWords := range []int{0, 2, 6} {
+		_, err := chunkEdges(req, maxWords)
+		var tooLarge *MessageTooLargeError
+		if !errors.As(err, &tooLarge) || tooLarge.Words != 7 || tooLarge.MaxWords != maxWords {
+			t.Fatalf("cap %d: got %v, expected a single edge not to fit", maxWords, err)
+		}
+	}
+}
+
+func TestChunkEdgesEmpty(t *testing.T) {
+	chunks, err := chunkEdges(&comms.Edges{SrcId: 1, NoMoreUpdates: true}, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 1 || chunks[0].GetNumChunks() != 1 || !chunks[0].GetNoMoreUpdates() {
+		t.Fatalf("got %v, expected a single empty chunk", chunks)
+	}
+}
+
+func TestChunkUpdateRoundTrip(t *testing.T) {
+	update := make(map[int32]int32)
+	for fragment := int32(0); fragment < 51; fragment++ {
+		update[fragment*3] = fragment
+	}
+
+	for _, maxWords := range []int{2, 5, 40, 1000} {
+		first, err := chunkUpdate(update, 6, 0, maxWords)
+		if err != nil {
+			t.Fatalf("cap %d: %v", maxWords, err)
+		}
+
+		got := make(map[int32]int32)
+		for i := int32(0); i < first.GetNumChunks(); i++ {
+			chunk, err := chunkUpdate(update, 6, i, maxWords)
+			if err != nil {
+				t.Fatalf("cap %d: chunk %d: %v", maxWords, i, err)
+			}
+			if words := updateWords(chunk); words > maxWords {
+				t.Fatalf("cap %d: chunk %d holds %d words", maxWords, i, words)
+			}
+			if chunk.GetPhase() != 6 || chunk.GetChunk() != i || chunk.GetNumChunks() != first.GetNumChunks() {
+				t.Fatalf("cap %d: chunk %d is numbered %d of %d in phase %d", maxWords, i, chunk.GetChunk(), chunk.GetNumChunks(), chunk.GetPhase())
+			}
+			for fragment, target := range chunk.GetUpdates() {
+				if _, ok := got[fragment]; ok {
+					t.Fatalf("cap %d: fragment %d is sent twice", maxWords, fragment)
+				}
+				got[fragment] = target
+			}
+		}
+
+		if len(got) != len(update) {
+			t.Fatalf("cap %d: got %d fragments back, expected %d", maxWords, len(got), len(update))
+		}
+		for fragment, target := range update {
+			if got[fragment] != target {
+				t.Fatalf("cap %d: fragment %d came back as %d, expected %d", maxWords, fragment, got[fragment], target)
+			}
+		}
+
+		if _, err := chunkUpdate(update, 6, first.GetNumChunks(), maxWords); err == nil {
+			t.Fatalf("cap %d: expected no chunk past the last", maxWords)
+		}
+	}
+}
+
+func TestChunkUpdateTooSmall(t *testing.T) {
+	_, err := chunkUpdate(map[int32]int32{1: 2}, 0, 0, 1)
+	var tooLarge *MessageTooLargeError
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("got %v, expected a single fragment not to fit", err)
+	}
+
+	// an empty update still goes down, as a single chunk
+	chunk, err := chunkUpdate(map[int32]int32{}, 0, 0, wordsPerFragment)
+	if err != nil || chunk.GetNumChunks() != 1 || len(chunk.GetUpdates()) != 0 {
+		t.Fatalf("got %v and %v, expected a single empty chunk", chunk, err)
+	}
+}
@@ -2,27 +2,36 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
 	comms "mst/sublinear/comms"
 	utils "mst/sublinear/utils"
+	"time"
 
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
-func (s *SubLinearServer) getEdgesToSend() (bool, []*utils.Edge, map[int32]int32) {
-	adjacencyList := utils.CreateAdjacencyList(s.nodeData.edges)
+func (s *SubLinearServer) getEdgesToSend() (bool, []*utils.Edge, map[int32]int32, error) {
+	edges, err := s.nodeData.GetEdges()
+	if err != nil {
+		return false, nil, nil, err
+	}
+	adjacencyList := utils.CreateAdjacencyList(edges)
 	moes := utils.GetMoEs(adjacencyList, s.nodeData.fragments)
 
+	// only blue fragments hook onto red ones through their moe, so the moe of a red
+	// fragment is never used. The moe of a blue fragment is kept regardless of the
+	// colour of its target, because only the root sees the true (global) moe.
 	filteredMoes := make([]*utils.Edge, 0)
 	sr := NewSharedRandomness()
 	round := int(s.nodeData.md.phase)
 	for _, edge := range moes {
-		uCol := sr.GetFragmentColour(round, int(edge.U))
-		vCol := sr.GetFragmentColour(round, int(edge.V))
-		if uCol == vCol {
-			log.Printf("---> %d and %d have the same colour, skipping", edge.U, edge.V)
+		if sr.GetFragmentColour(round, int(s.nodeData.fragments[edge.U])) == RedFrag {
+			continue
 		}
 		filteredMoes = append(filteredMoes, edge)
 	}
@@ -34,22 +43,16 @@ func (s *SubLinearServer) getEdgesToSend() (bool, []*utils.Edge, map[int32]int32
 		}
 	}
 
-	noMoreUpdates := len(filteredMoes) == 0
-	return noMoreUpdates, filteredMoes, fragments
+	// the colouring may filter out every moe in a round, so we are only done when
+	// there are no outgoing edges left at all, in this node and all of its children
+	noMoreUpdates := len(moes) == 0 && !s.nodeData.md.hasChildren()
+	return noMoreUpdates, filteredMoes, fragments, nil
 }
 
 func (s *SubLinearServer) sendEdgesUp(noMoreUpdates bool, edges []*utils.Edge, fragments map[int32]int32) (*comms.Update, error) {
 	if s.nodeData.md.parent == nil {
 		return nil, fmt.Errorf("no parent node to send edges to")
 	}
-	receiverAddr := s.nodeData.md.parent.GetAddr()
-
-	conn, err := grpc.NewClient(receiverAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		return nil, fmt.Errorf("unable to create client connection: %v", err)
-	}
-	defer conn.Close()
-	client := comms.NewEdgeDataServiceClient(conn)
 
 	moeData := make([]*comms.EdgeData, len(edges))
 	for i, edge := range edges {
@@ -61,17 +64,176 @@ func (s *SubLinearServer) sendEdgesUp(noMoreUpdates bool, edges []*utils.Edge, f
 	}
 	log.Printf("%d - sending %v edges and %v fragments to %d", s.nodeData.md.id, moeData, fragments, s.nodeData.md.parent.id)
 
-	req := &comms.Edges{SrcId: s.nodeData.md.id, NoMoreUpdates: noMoreUpdates, Edges: moeData, FragmentIds: fragments}
+	req := &comms.Edges{
+		SrcId:         s.nodeData.md.id,
+		NoMoreUpdates: noMoreUpdates,
+		Edges:         moeData,
+		FragmentIds:   fragments,
+		Phase:         s.nodeData.md.phase,
+		AcceptsPacked: s.packed,
+		JobId:         s.jobId,
+	}
+
+	chunks, err := chunkEdges(req, s.maxMessageWords)
+	if err != nil {
+		return nil, fmt.Errorf("failed to chunk edge data: %v", err)
+	}
+	if len(chunks) > 1 {
+		log.Printf("%d - sending edges in %d chunks", s.nodeData.md.id, len(chunks))
+	}
+
+	// the reply to the last chunk is the first chunk of the update. A chunk may be sent
+	// more than once, and the parent takes in only the first.
+	var update *comms.Update
+	for _, chunk := range chunks {
+		err = s.retry(fmt.Sprintf("sending chunk %d of phase %d", chunk.GetChunk(), chunk.GetPhase()), func(ctx context.Context) error {
+			update, err = s.sendChunk(ctx, chunk)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to send edge data: %w", err)
+		}
+	}
+
+	updates := make(map[int32]int32)
+	for i := int32(0); i < max(1, update.GetNumChunks()); i++ {
+		if i > 0 {
+			fetchReq := &comms.UpdateRequest{SrcId: s.nodeData.md.id, Phase: req.GetPhase(), Chunk: i, AcceptsPacked: s.packed, JobId: s.jobId}
+			err = s.retry(fmt.Sprintf("fetching chunk %d of the update of phase %d", i, req.GetPhase()), func(ctx context.Context) error {
+				update, err = s.transport.FetchUpdate(ctx, s.nodeData.md.parent, fetchReq)
+				if err != nil {
+					return err
+				}
+				update, err = s.decodeUpdate(update)
+				return err
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch chunk %d of the update: %w", i, err)
+			}
+		}
 
-	ctx, cancel := context.WithTimeout(context.Background(), utils.RpcTimeout())
+		if err := s.checkUpdate(update, req.GetPhase()); err != nil {
+			return nil, fmt.Errorf("chunk %d of the update: %v", i, err)
+		}
+		if update.GetChunk() != i {
+			return nil, fmt.Errorf("received chunk %d of the update instead of %d", update.GetChunk(), i)
+		}
+		if words := updateWords(update); words > s.maxMessageWords {
+			err := &MessageTooLargeError{Words: words, MaxWords: s.maxMessageWords}
+			return nil, fmt.Errorf("chunk %d of the update is a %v", i, err)
+		}
+		maps.Copy(updates, update.GetUpdates())
+	}
+
+	return &comms.Update{Updates: updates, Phase: req.GetPhase(), JobId: s.jobId}, nil
+}
+
+// checks that an update from the parent is of our run, and of the phase we expect
+func (s *SubLinearServer) checkUpdate(update *comms.Update, phase int32) error {
+	if update.GetJobId() != s.jobId {
+		return fmt.Errorf("parent sent an update of job %q, in job %q", update.GetJobId(), s.jobId)
+	}
+	if update.GetPhase() != phase {
+		return fmt.Errorf("parent sent the update of phase %d, in phase %d", update.GetPhase(), phase)
+	}
+	return nil
+}
+
+// the longest wait between two retries
+const maxRetryBackoff = 5 * time.Second
+
+// makes a call to the parent, and makes it again after a growing backoff as long as
+// it fails in a way that may pass. All the attempts share a single rpc timeout, so a
+// dead parent holds the node up for no longer than one call to a live one would.
+func (s *SubLinearServer) retry(what string, call func(ctx context.Context) error) error {
+	ctx, cancel := s.callContext()
 	defer cancel()
 
-	update, err := client.PropogateUp(ctx, req)
+	backoff := s.retryBackoff
+	for attempt := 1; ; attempt++ {
+		err := call(ctx)
+		if err == nil || attempt > s.retries || !retryable(ctx, err) {
+			return err
+		}
+
+		log.Printf("[WARN] %d - %s failed (attempt %d of %d), retrying in %v: %v", s.nodeData.md.id, what, attempt, s.retries+1, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff = min(2*backoff, maxRetryBackoff)
+	}
+}
+
+// the context of a call to the parent and its retries. Over a stream, which lives for
+// the whole run, a call waits for the update for as long as it takes: a broken stream
+// fails it, and a parent that hangs is found by heartbeats instead.
+func (s *SubLinearServer) callContext() (context.Context, context.CancelFunc) {
+	if s.stream {
+		return context.WithCancel(s.ctx)
+	}
+	return context.WithTimeout(s.ctx, utils.RpcTimeout())
+}
+
+// how long a child keeps retrying a call that fails straight away
+func retryWindow(retries int, backoff time.Duration) time.Duration {
+	window := time.Duration(0)
+	for range retries {
+		window += backoff
+		backoff = min(2*backoff, maxRetryBackoff)
+	}
+	return window
+}
+
+// whether a failed call to the parent is worth making again within ctx: the
+// connection broke, the message was corrupted on the way (DataLoss) or the parent
+// gave up on the call, but it did not turn the message down. A message over the size
+// gRPC allows (ResourceExhausted) is turned down, as it would be every time.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Aborted, codes.DataLoss:
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// sends a chunk of edges up, packed if the parent agreed to it
+func (s *SubLinearServer) sendChunk(ctx context.Context, chunk *comms.Edges) (*comms.Update, error) {
+	msg := chunk
+	if s.parentPacked {
+		msg = packEdgesMessage(chunk)
+	}
+	s.addWireBytes(proto.Size(msg), proto.Size(chunk))
+
+	update, err := s.transport.SendUp(ctx, s.nodeData.md.parent, msg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send edge data: %v", err)
+		return nil, err
 	}
+	return s.decodeUpdate(update)
+}
 
-	return update, nil
+// unpacks an update from the parent. The first packed one tells us the parent
+// reads packed edges too.
+func (s *SubLinearServer) decodeUpdate(update *comms.Update) (*comms.Update, error) {
+	plain, err := unpackUpdateMessage(update)
+	if err != nil {
+		return nil, fmt.Errorf("parent sent %v", err)
+	}
+	if failure := update.GetFailure(); failure != nil {
+		return nil, &abortedError{cause: nodeErrorFromProto(failure)}
+	}
+	s.addWireBytes(proto.Size(update), proto.Size(plain))
+
+	if update.GetEncoding() == comms.Encoding_PACKED && s.packed && !s.parentPacked {
+		log.Printf("%d - parent %d agreed to the packed encoding", s.nodeData.md.id, s.nodeData.md.parent.id)
+		s.parentPacked = true
+	}
+
+	return plain, nil
 }
 
 func (s *SubLinearServer) leafDriver() error {
@@ -80,30 +242,50 @@ func (s *SubLinearServer) leafDriver() error {
 	}
 
 	for {
-		allSame, edges, fragments := s.getEdgesToSend()
-		update, err := s.sendEdgesUp(allSame, edges, fragments)
+		if err := s.checkpoint(s.nodeData.md.phase, false); err != nil {
+			return err
+		}
+		if s.crash && s.nodeData.md.phase == s.crashPhase {
+			log.Printf("[WARN] %d - crashing in phase %d, as asked", s.nodeData.md.id, s.nodeData.md.phase)
+			return errCrashed
+		}
+
+		// filter on the partition at first, and then again after every relabel
+		dropped, err := s.nodeData.FilterEdges()
 		if err != nil {
-			return fmt.Errorf("failed to send edges up: %v", err)
+			return fmt.Errorf("failed to filter edges: %v", err)
+		}
+		if dropped > 0 {
+			log.Printf("%d - dropped %d edges closing local cycles", s.nodeData.md.id, dropped)
 		}
 
-		// update state of leaf based on update
-		for srcFrag, trgFrag := range update.GetUpdates() {
-			for node, frag := range s.nodeData.fragments {
-				if frag != srcFrag {
-					continue
-				}
-				log.Printf("----> updating node %d from %d to %d", node, frag, trgFrag)
-				s.nodeData.UpdateFragment(node, trgFrag)
-			}
+		noMoreUpdates, edges, fragments, err := s.getEdgesToSend()
+		if err != nil {
+			return fmt.Errorf("failed to get edges to send: %v", err)
+		}
+		update, err := s.sendEdgesUp(noMoreUpdates, edges, fragments)
+		if err != nil {
+			return fmt.Errorf("failed to send edges up: %w", err)
+		}
+
+		// update state of leaf based on update, which has to be of this phase
+		if err := s.checkUpdate(update, s.nodeData.md.phase); err != nil {
+			return err
+		}
+		s.nodeData.RelabelFragments(update.GetUpdates())
+		freed, err := s.nodeData.ContractEdges()
+		if err != nil {
+			return fmt.Errorf("failed to contract edges: %v", err)
 		}
+		log.Printf("%d - phase %d: contraction freed %d edges", s.nodeData.md.id, s.nodeData.md.phase, freed)
 
 		s.nodeData.md.progressPhase()
 
-		// if we did not send any edges in the last update, break
-		if len(edges) == 0 {
+		// if we have no outgoing edges left, break
+		if noMoreUpdates {
 			break
 		}
 	}
 
-	return nil
+	return s.checkpoint(s.nodeData.md.phase, true)
 }
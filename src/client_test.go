@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	comms "mst/sublinear/comms"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRetryable(t *testing.T) {
+	cases := []struct {
+		err       error
+		retryable bool
+	}{
+		{status.Error(codes.Unavailable, "connection broke"), true},
+		{status.Error(codes.DeadlineExceeded, "parent gave up"), true},
+		{status.Error(codes.Aborted, "aborted"), true},
+		{status.Error(codes.DataLoss, "corrupted on the way"), true},
+		{fmt.Errorf("failed to send: %w", context.DeadlineExceeded), true},
+		// gRPC turns down a message over its size every time
+		{status.Error(codes.ResourceExhausted, "message larger than max"), false},
+		{status.Error(codes.InvalidArgument, "wrong job"), false},
+		{status.Error(codes.FailedPrecondition, "wrong phase"), false},
+		{&abortedError{cause: &NodeError{NodeId: 1, Reason: "over budget"}}, false},
+		{errors.New("parent sent a corrupt update"), false},
+	}
+	for _, tc := range cases {
+		if got := retryable(context.Background(), tc.err); got != tc.retryable {
+			t.Errorf("%v: got retryable %v, expected %v", tc.err, got, tc.retryable)
+		}
+	}
+
+	// nothing is worth retrying once the node gave up
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if retryable(ctx, status.Error(codes.Unavailable, "connection broke")) {
+		t.Error("expected no retry in a cancelled context")
+	}
+}
+
+// a server that only retries calls, without a tree around it
+func newRetryServer(retries int) *SubLinearServer {
+	return &SubLinearServer{
+		ctx:          context.Background(),
+		nodeData:     NewNodeData(NewRemoteNodeMetaData(1, "mem-1"), &NodeBudget{words: 100}),
+		retries:      retries,
+		retryBackoff: time.Millisecond,
+	}
+}
+
+func TestRetry(t *testing.T) {
+	cases := []struct {
+		name     string
+		errs     []error
+		attempts int
+		fails    bool
+	}{
+		{"succeeds", nil, 1, false},
+		{"passes on retry", []error{status.Error(codes.Unavailable, ""), status.Error(codes.Aborted, "")}, 3, false},
+		{"runs out of retries", []error{status.Error(codes.Unavailable, ""), status.Error(codes.Unavailable, ""), status.Error(codes.Unavailable, ""), status.Error(codes.Unavailable, "")}, 4, true},
+		{"too large", []error{status.Error(codes.ResourceExhausted, "")}, 1, true},
+		{"turned down", []error{status.Error(codes.FailedPrecondition, "")}, 1, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			attempts := 0
+			err := newRetryServer(3).retry("calling", func(ctx context.Context) error {
+				attempts++
+				if attempts <= len(tc.errs) {
+					return tc.errs[attempts-1]
+				}
+				return nil
+			})
+			if attempts != tc.attempts || (err != nil) != tc.fails {
+				t.Fatalf("got %d attempts and %v, expected %d attempts, failing %v", attempts, err, tc.attempts, tc.fails)
+			}
+		})
+	}
+}
+
+// the attempts share a deadline, which the calls see
+func TestRetrySharesDeadline(t *testing.T) {
+	var deadlines []time.Time
+	_ = newRetryServer(3).retry("calling", func(ctx context.Context) error {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			t.Fatal("expected the call to have a deadline")
+		}
+		deadlines = append(deadlines, deadline)
+		return status.Error(codes.Unavailable, "")
+	})
+	if len(deadlines) != 4 {
+		t.Fatalf("got %d attempts, expected 4", len(deadlines))
+	}
+	for i, deadline := range deadlines {
+		if !deadline.Equal(deadlines[0]) {
+			t.Fatalf("attempt %d has a deadline of its own", i+1)
+		}
+	}
+}
+
+// a child sends the same chunk twice over bufconn, as it does when the reply to the
+// first was lost, and the parent takes its edges in once
+func TestRedeliveredChunkAppliedOnce(t *testing.T) {
+	network := NewBufconnNetwork()
+	cfg := TransportConfig{maxMessageWords: 1000}
+
+	parentMd := NewRemoteNodeMetaData(1, "mem-1")
+	childMd := NewRemoteNodeMetaData(2, "mem-2")
+	parentMd.SetChildren([]*NodeMetaData{childMd})
+	childMd.SetParent(parentMd)
+
+	parent, err := NewSubLinearServer(context.Background(), NewNodeData(parentMd, &NodeBudget{words: 1000}),
+		ServerConfig{maxMessageWords: 1000, jobId: "job"}, network.Transport(parentMd.GetAddr(), cfg, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer parent.ShutDown()
+
+	child := network.Transport(childMd.GetAddr(), cfg, nil)
+	defer child.Stop()
+
+	// the first of two chunks, which the parent answers without waiting for the update
+	chunk := &comms.Edges{
+		SrcId:       childMd.id,
+		Phase:       0,
+		Chunk:       0,
+		NumChunks:   2,
+		JobId:       "job",
+		Edges:       []*comms.EdgeData{{U: 1, V: 2, Weight: 5}, {U: 2, V: 3, Weight: -1}},
+		FragmentIds: map[int32]int32{1: 1, 2: 2, 3: 3},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for i := range 2 {
+		if _, err := child.SendUp(ctx, parentMd, chunk); err != nil {
+			t.Fatalf("delivery %d: %v", i+1, err)
+		}
+	}
+
+	edges, err := parent.nodeData.GetEdges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(edges) != len(chunk.GetEdges()) {
+		t.Fatalf("parent holds %d edges, expected the %d of the chunk", len(edges), len(chunk.GetEdges()))
+	}
+	if parent.receivedWords != numWords(chunk) {
+		t.Fatalf("parent counted %d words, expected the %d of the chunk", parent.receivedWords, numWords(chunk))
+	}
+
+	// a chunk of another job is turned down, and not retried
+	chunk.JobId = "other"
+	_, err = child.SendUp(ctx, parentMd, chunk)
+	if status.Code(err) != codes.InvalidArgument || retryable(ctx, err) {
+		t.Fatalf("got %v, expected the chunk of another job to be turned down", err)
+	}
+}
+
+// calls over a stream wait for the update for as long as the stream lives
+func TestCallContext(t *testing.T) {
+	s := newRetryServer(0)
+	ctx, cancel := s.callContext()
+	defer cancel()
+	if _, ok := ctx.Deadline(); !ok {
+		t.Fatal("expected a unary call to have a deadline")
+	}
+
+	s.stream = true
+	ctx, cancel = s.callContext()
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Fatal("expected a call over a stream to have no deadline")
+	}
+}
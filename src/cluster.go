@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	utils "mst/sublinear/utils"
+)
+
+// the topology of a single node of the tree
+type NodeManifest struct {
+	Id       int32   `json:"id"`
+	Addr     string  `json:"addr"`
+	Parent   int32   `json:"parent"` // -1 for the root
+	Children []int32 `json:"children"`
+	// the edges of a leaf, relative to the directory of the manifest
+	EdgesFile string `json:"edgesFile,omitempty"`
+}
+
+// everything a worker needs to run its node of the tree, written by the coordinator
+type ClusterManifest struct {
+	OutFile         string `json:"outFile"`
+	WordLimit       int32  `json:"wordLimit"`
+	StrictWordLimit bool   `json:"strictWordLimit"`
+	Budget          int    `json:"budget"`
+	BudgetPolicy    string `json:"budgetPolicy"`
+	SpillDir        string `json:"spillDir"`
+	Stream          bool   `json:"stream"`
+	MaxMessageWords int    `json:"maxMessageWords"`
+	Packed          bool   `json:"packed"`
+	JobId           string `json:"jobId"`
+	Retries         int    `json:"retries"`
+	RetryBackoff    string `json:"retryBackoff"`
+	// where nodes write their checkpoints, and the phase to resume from if set
+	CheckpointDir string `json:"checkpointDir,omitempty"`
+	Resume        bool   `json:"resume,omitempty"`
+	ResumePhase   int32  `json:"resumePhase,omitempty"`
+	// how often children send heartbeats (none if empty), and how long a parent
+	// waits on a silent child before failing the run
+	Heartbeat string `json:"heartbeat,omitempty"`
+	DeadAfter string `json:"deadAfter,omitempty"`
+	// how long a worker waits on its node to progress before it exits with a dump of
+	// it (no watchdog if empty), and the file the dumps of the nodes are named after
+	Watchdog     string `json:"watchdog,omitempty"`
+	WatchdogFile string `json:"watchdogFile,omitempty"`
+	// the fault policy every worker injects faults by, for chaos testing
+	FaultsFile string `json:"faultsFile,omitempty"`
+	// certificates of the nodes, for mutual TLS (plaintext if empty)
+	CertsDir string         `json:"certsDir,omitempty"`
+	Nodes    []NodeManifest `json:"nodes"`
+}
+
+func ReadManifest(fileName string) (*ClusterManifest, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &ClusterManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+
+	return manifest, nil
+}
+
+func (manifest *ClusterManifest) Write(fileName string) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(fileName, data, 0644)
+}
+
+func (manifest *ClusterManifest) GetNode(id int32) (*NodeManifest, error) {
+	for i := range manifest.Nodes {
+		if manifest.Nodes[i].Id == id {
+			return &manifest.Nodes[i], nil
+		}
+	}
+	return nil, fmt.Errorf("node %d not in manifest", id)
+}
+
+// builds the tree and writes its manifest, along with the edges of every leaf next
+// to it, for the nodes to be run as separate workers
+func runCoordinator(graphFile, outFile, manifestFile string, cfg *RunConfig) (*ClusterManifest, error) {
+	if cfg.deadChildPolicy == StandbyOnDeadChild {
+		return nil, fmt.Errorf("standby nodes only run in a single process, workers abort on a dead child")
+	}
+
+	tree, err := buildTree(graphFile, cfg)
+	if err != nil {
+		return nil, err
+	}
+	logPartitionStats(cfg.partitionStrategy, tree.partitionStats)
+
+	absOutFile, err := filepath.Abs(outFile)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &ClusterManifest{
+		OutFile:         absOutFile,
+		WordLimit:       tree.md.NumEdgesPerNode(),
+		StrictWordLimit: cfg.strictWordLimit,
+		Budget:          tree.budget.words,
+		BudgetPolicy:    tree.budget.policy.String(),
+		SpillDir:        tree.budget.spillDir,
+		Stream:          cfg.stream,
+		MaxMessageWords: tree.maxMessageWords,
+		Packed:          cfg.packed,
+		JobId:           tree.jobId,
+		Retries:         cfg.retries,
+		RetryBackoff:    cfg.retryBackoff.String(),
+	}
+	if cfg.heartbeat > 0 {
+		manifest.Heartbeat = cfg.heartbeat.String()
+		manifest.DeadAfter = cfg.deadAfter.String()
+	}
+	if cfg.faultsFile != "" {
+		if manifest.FaultsFile, err = filepath.Abs(cfg.faultsFile); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.watchdog > 0 {
+		manifest.Watchdog = cfg.watchdog.String()
+		if manifest.WatchdogFile, err = filepath.Abs(cfg.watchdogFile); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.certsDir != "" {
+		if manifest.CertsDir, err = filepath.Abs(cfg.certsDir); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.checkpointDir != "" {
+		if manifest.CheckpointDir, err = filepath.Abs(cfg.checkpointDir); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.resume {
+		// the workers restore their own nodes, from the phase every node started
+		phase, _, err := resumePoint(cfg.checkpointDir)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("resume    : from phase %d", phase)
+		manifest.Resume = true
+		manifest.ResumePhase = phase
+	} else if cfg.checkpointDir != "" {
+		if err := clearCheckpoints(cfg.checkpointDir); err != nil {
+			return nil, err
+		}
+	}
+
+	dir := filepath.Dir(manifestFile)
+	for _, node := range tree.nodes {
+		entry := NodeManifest{Id: node.md.id, Addr: node.md.GetAddr(), Parent: -1, Children: []int32{}}
+		if node.md.parent != nil {
+			entry.Parent = node.md.parent.id
+		}
+		for _, child := range node.md.children {
+			entry.Children = append(entry.Children, child.id)
+		}
+
+		if node.md.isLeaf() {
+			edges, err := node.GetEdges()
+			if err != nil {
+				return nil, err
+			}
+
+			entry.EdgesFile = fmt.Sprintf("node-%d.txt", node.md.id)
+			edgesFile := filepath.Join(dir, entry.EdgesFile)
+			if err := os.WriteFile(edgesFile, nil, 0644); err != nil {
+				return nil, fmt.Errorf("failed to create edges file: %v", err)
+			}
+			if err := utils.WriteGraph(edgesFile, edges); err != nil {
+				return nil, fmt.Errorf("failed to write edges file: %v", err)
+			}
+			if err := node.ClearEdges(); err != nil {
+				return nil, err
+			}
+		}
+
+		manifest.Nodes = append(manifest.Nodes, entry)
+	}
+
+	if err := manifest.Write(manifestFile); err != nil {
+		return nil, fmt.Errorf("failed to write manifest: %v", err)
+	}
+
+	return manifest, nil
+}
+
+// runs a single node of the tree, learning its topology from the manifest. The
+// certificates may be overridden by certsDir, as they may live elsewhere on the
+// machine of the worker.
+func runWorker(manifestFile string, id int32, certsDir string) error {
+	manifest, err := ReadManifest(manifestFile)
+	if err != nil {
+		return fmt.Errorf("failed to read manifest: %v", err)
+	}
+
+	entry, err := manifest.GetNode(id)
+	if err != nil {
+		return err
+	}
+
+	policy, err := ParseBudgetPolicy(manifest.BudgetPolicy)
+	if err != nil {
+		return err
+	}
+	budget := &NodeBudget{words: manifest.Budget, policy: policy, spillDir: manifest.SpillDir}
+
+	var retryBackoff time.Duration
+	if manifest.RetryBackoff != "" {
+		if retryBackoff, err = time.ParseDuration(manifest.RetryBackoff); err != nil {
+			return fmt.Errorf("failed to parse retry backoff: %v", err)
+		}
+	}
+
+	liveness := LivenessConfig{policy: AbortOnDeadChild}
+	if manifest.Heartbeat != "" {
+		if liveness.interval, err = time.ParseDuration(manifest.Heartbeat); err != nil {
+			return fmt.Errorf("failed to parse heartbeat interval: %v", err)
+		}
+		if liveness.deadAfter, err = time.ParseDuration(manifest.DeadAfter); err != nil {
+			return fmt.Errorf("failed to parse dead after: %v", err)
+		}
+	}
+
+	var watchdog time.Duration
+	if manifest.Watchdog != "" {
+		if watchdog, err = time.ParseDuration(manifest.Watchdog); err != nil {
+			return fmt.Errorf("failed to parse watchdog timeout: %v", err)
+		}
+	}
+
+	lis, err := net.Listen("tcp", entry.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", entry.Addr, err)
+	}
+	node := NewNodeData(NewNodeMetaData(id, lis), budget)
+
+	if entry.Parent >= 0 {
+		parent, err := manifest.GetNode(entry.Parent)
+		if err != nil {
+			return err
+		}
+		node.md.SetParent(NewRemoteNodeMetaData(parent.Id, parent.Addr))
+	}
+
+	children := []*NodeMetaData{}
+	for _, childId := range entry.Children {
+		child, err := manifest.GetNode(childId)
+		if err != nil {
+			return err
+		}
+		children = append(children, NewRemoteNodeMetaData(child.Id, child.Addr))
+	}
+	node.md.SetChildren(children)
+
+	if entry.EdgesFile != "" {
+		edges, err := utils.ReadGraph(filepath.Join(filepath.Dir(manifestFile), entry.EdgesFile))
+		if err != nil {
+			return fmt.Errorf("failed to read edges: %v", err)
+		}
+		if err := initLeaf(node, edges); err != nil {
+			return err
+		}
+	}
+
+	isRoot := node.md.isRoot()
+	if manifest.Resume {
+		phases, err := listCheckpoints(manifest.CheckpointDir)
+		if err != nil {
+			return err
+		}
+		cp, err := loadCheckpoint(manifest.CheckpointDir, id, manifest.ResumePhase, phases[id])
+		if err != nil {
+			return err
+		}
+		if cp.Done {
+			log.Printf("===> node %d was done by phase %d", id, cp.Phase)
+			return nil
+		}
+		if err := restoreNode(node, cp); err != nil {
+			return err
+		}
+		if isRoot {
+			if err := restoreOutput(manifest.OutFile, cp); err != nil {
+				return err
+			}
+		}
+	} else if isRoot {
+		if err := startOutput(manifest.OutFile); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("node: %s", node.String())
+	// workers are separate processes, so they always talk over gRPC
+	if certsDir == "" {
+		certsDir = manifest.CertsDir
+	}
+	transportCfg := TransportConfig{stream: manifest.Stream, maxMessageWords: manifest.MaxMessageWords, certsDir: certsDir}
+	if manifest.FaultsFile != "" {
+		// every worker counts the messages it sees by itself
+		if transportCfg.faults, err = ReadFaultPolicy(manifest.FaultsFile); err != nil {
+			return err
+		}
+	}
+	tlsConfig, err := transportCfg.nodeTLS(id)
+	if err != nil {
+		return err
+	}
+	transport := NewGrpcTransport(lis, transportCfg, tlsConfig)
+	serverCfg := ServerConfig{
+		outFile:         partialFile(manifest.OutFile),
+		wordLimit:       manifest.WordLimit,
+		strictWordLimit: manifest.StrictWordLimit,
+		maxMessageWords: manifest.MaxMessageWords,
+		packed:          manifest.Packed,
+		jobId:           manifest.JobId,
+		retries:         manifest.Retries,
+		retryBackoff:    retryBackoff,
+		stream:          manifest.Stream,
+		checkpointDir:   manifest.CheckpointDir,
+		liveness:        liveness,
+	}
+	server, err := NewSubLinearServer(context.Background(), node, serverCfg, transport)
+	if err != nil {
+		return fmt.Errorf("failed to create server: %v", err)
+	}
+	// the node no longer progresses once its driver is done, so the watchdog only
+	// runs along with it. A worker only knows of its own node, so its dump is of that
+	// node alone.
+	watched := func() []*NodeData { return []*NodeData{node} }
+	stopWatchdog := startWatchdog(watched, watchdog, nodeDumpFile(manifest.WatchdogFile, id))
+	err = runServer(server)
+	stopWatchdog()
+	// the children are in processes of their own, and may still retry their last
+	// message for a while
+	time.Sleep(retryWindow(manifest.Retries, retryBackoff))
+	server.ShutDown()
+	if err != nil {
+		if isRoot {
+			abandonOutput(manifest.OutFile, manifest.CheckpointDir)
+		}
+		return err
+	}
+
+	log.Printf("===> node %d complete in %d rounds", id, node.md.phase)
+	logSummary([]*SubLinearServer{server}, manifest.WordLimit, budget)
+
+	if isRoot {
+		return finaliseForest(manifest.OutFile)
+	}
+	return nil
+}
+
+func coordinatorMain(args []string) {
+	fs := flag.NewFlagSet("coordinator", flag.ExitOnError)
+	buildConfig := addRunFlags(fs)
+	manifestFile := fs.String("manifest", "manifest.json", "file to write the cluster manifest to")
+	host := fs.String("host", "127.0.0.1", "host the workers listen on")
+	basePort := fs.Int("base-port", 50051, "port of node 0, node i listens on base-port+i")
+	fs.Usage = func() {
+		fmt.Println("usage: go run *.go coordinator [flags] <infile> <outfile> <alpha>")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	infile, outfile, alpha := parseRunArgs(fs)
+	cfg, err := buildConfig(alpha)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	cfg.host = *host
+	cfg.basePort = *basePort
+
+	manifest, err := runCoordinator(infile, outfile, *manifestFile, cfg)
+	if err != nil {
+		log.Fatalf("[ERROR] failed to coordinate: %v", err)
+	}
+
+	log.Printf("===> wrote manifest of %d nodes to %s, start every node with:", len(manifest.Nodes), *manifestFile)
+	log.Printf("go run *.go worker -manifest %s -id <node id>", *manifestFile)
+}
+
+func workerMain(args []string) {
+	fs := flag.NewFlagSet("worker", flag.ExitOnError)
+	manifestFile := fs.String("manifest", "manifest.json", "cluster manifest written by the coordinator")
+	id := fs.Int("id", -1, "id of the node to run")
+	certsDir := fs.String("certs", "", "directory of the node certificates (default: the one in the manifest)")
+	_ = fs.Parse(args)
+
+	if *id < 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	if err := runWorker(*manifestFile, int32(*id), *certsDir); err != nil {
+		log.Fatalf("[ERROR] worker %d failed: %v", *id, err)
+	}
+}
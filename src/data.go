@@ -5,7 +5,9 @@ import (
 	"log"
 	"math/rand"
 	"net"
+	"strconv"
 	"sync"
+	"time"
 
 	utils "mst/sublinear/utils"
 )
@@ -13,19 +15,38 @@ import (
 type NodeMetaData struct {
 	stateMutex sync.Mutex
 	id         int32
-	lis        net.Listener
+	addr       string
+	lis        net.Listener // nil for nodes served elsewhere
 	parent     *NodeMetaData
 	children   []*NodeMetaData
 	phase      int32
+	// when each child was last heard from, by heartbeat or message
+	lastSeen map[int32]time.Time
 }
 
 func NewNodeMetaData(id int32, lis net.Listener) *NodeMetaData {
 	return &NodeMetaData{
 		id:       id,
+		addr:     lis.Addr().String(),
 		lis:      lis,
 		parent:   nil,
 		children: []*NodeMetaData{},
 		phase:    0,
+		lastSeen: make(map[int32]time.Time),
+	}
+}
+
+// the metadata of a node that is served by another process (or not yet served at
+// all), known only by its id and address
+func NewRemoteNodeMetaData(id int32, addr string) *NodeMetaData {
+	return &NodeMetaData{
+		id:       id,
+		addr:     addr,
+		lis:      nil,
+		parent:   nil,
+		children: []*NodeMetaData{},
+		phase:    0,
+		lastSeen: make(map[int32]time.Time),
 	}
 }
 
@@ -46,9 +67,7 @@ func (md *NodeMetaData) String() string {
 		parentData = fmt.Sprintf("%d", parent.id)
 	}
 
-	addr := md.lis.Addr().String()
-
-	return fmt.Sprintf("{id: %d, addr: %s, children: %v, parent: %s}", md.id, addr, childrenData, parentData)
+	return fmt.Sprintf("{id: %d, addr: %s, children: %v, parent: %s}", md.id, md.addr, childrenData, parentData)
 }
 
 func (md *NodeMetaData) progressPhase() {
@@ -58,11 +77,18 @@ func (md *NodeMetaData) progressPhase() {
 	md.phase++
 }
 
+func (md *NodeMetaData) getPhase() int32 {
+	md.stateMutex.Lock()
+	defer md.stateMutex.Unlock()
+
+	return md.phase
+}
+
 func (md *NodeMetaData) GetAddr() string {
 	md.stateMutex.Lock()
 	defer md.stateMutex.Unlock()
 
-	return md.lis.Addr().String()
+	return md.addr
 }
 
 func (md *NodeMetaData) SetParent(parent *NodeMetaData) {
@@ -83,6 +109,41 @@ func (md *NodeMetaData) RemoveChild(childId int32) {
 		md.children = append(md.children[:i], md.children[i+1:]...)
 		break
 	}
+	delete(md.lastSeen, childId)
+}
+
+// notes that a child is alive
+func (md *NodeMetaData) markAlive(childId int32) {
+	md.stateMutex.Lock()
+	defer md.stateMutex.Unlock()
+
+	if _, ok := md.lastSeen[childId]; ok {
+		md.lastSeen[childId] = time.Now()
+	}
+}
+
+// gives every child a fresh grace, as their supervision starts
+func (md *NodeMetaData) resetLiveness(now time.Time) {
+	md.stateMutex.Lock()
+	defer md.stateMutex.Unlock()
+
+	for id := range md.lastSeen {
+		md.lastSeen[id] = now
+	}
+}
+
+// the children not heard from for longer than deadAfter, with how long ago each was
+func (md *NodeMetaData) silentChildren(deadAfter time.Duration, now time.Time) map[int32]time.Duration {
+	md.stateMutex.Lock()
+	defer md.stateMutex.Unlock()
+
+	silent := make(map[int32]time.Duration)
+	for id, seen := range md.lastSeen {
+		if silence := now.Sub(seen); silence > deadAfter {
+			silent[id] = silence
+		}
+	}
+	return silent
 }
 
 func (md *NodeMetaData) isLeaf() bool {
@@ -92,6 +153,13 @@ func (md *NodeMetaData) isLeaf() bool {
 	return len(md.children) == 0 && md.parent != nil
 }
 
+func (md *NodeMetaData) hasChildren() bool {
+	md.stateMutex.Lock()
+	defer md.stateMutex.Unlock()
+
+	return len(md.children) > 0
+}
+
 func (md *NodeMetaData) isRoot() bool {
 	md.stateMutex.Lock()
 	defer md.stateMutex.Unlock()
@@ -104,6 +172,11 @@ func (md *NodeMetaData) SetChildren(children []*NodeMetaData) {
 	defer md.stateMutex.Unlock()
 
 	md.children = children
+	// every child gets the same grace from the start
+	md.lastSeen = make(map[int32]time.Time, len(children))
+	for _, child := range children {
+		md.lastSeen[child.id] = time.Now()
+	}
 }
 
 type NodeData struct {
@@ -112,25 +185,27 @@ type NodeData struct {
 
 	edgesMutex     sync.Mutex
 	edges          []*utils.Edge
-	updateMutex    sync.Mutex
-	update         map[int32]int32
 	fragmentsMutex sync.Mutex
 	fragments      map[int32]int32
 
-	// for tracking child requests
-	childReqWg sync.WaitGroup
-	updateCond sync.Cond
-}
+	// memory budget, and the edges spilled past it (guarded by both mutexes above)
+	budget     *NodeBudget
+	peakWords  int
+	spillFile  string
+	numSpilled int
 
-func NewNodeData(id int32, lis net.Listener) *NodeData {
-	metadata := NewNodeMetaData(id, lis)
+	// where the children meet the node in every phase, and the updates it published
+	barrier *PhaseBarrier
+}
 
+func NewNodeData(metadata *NodeMetaData, budget *NodeBudget) *NodeData {
 	return &NodeData{
-		md:         metadata,
-		edges:      []*utils.Edge{},
-		update:     make(map[int32]int32),
-		fragments:  make(map[int32]int32),
-		updateCond: *sync.NewCond(&sync.Mutex{}),
+		md:    metadata,
+		edges: []*utils.Edge{},
+		// no update yet, the children start with the edges of phase 0
+		barrier:   NewPhaseBarrier(),
+		fragments: make(map[int32]int32),
+		budget:    budget,
 	}
 }
 
@@ -150,25 +225,86 @@ func (node *NodeData) String() string {
 		node.md, edgeData, node.fragments)
 }
 
-func (node *NodeData) setUpdate(update map[int32]int32) {
-	node.updateMutex.Lock()
-	defer node.updateMutex.Unlock()
+func (node *NodeData) setUpdate(phase int32, update map[int32]int32) {
+	node.barrier.Publish(phase, update)
+}
 
-	node.update = update
+// the latest update, along with the phase it was decided in
+func (node *NodeData) getUpdate() (int32, map[int32]int32) {
+	return node.barrier.Published()
 }
 
-func (node *NodeData) ClearEdges() {
+func (node *NodeData) ClearEdges() error {
 	node.edgesMutex.Lock()
 	defer node.edgesMutex.Unlock()
 
 	node.edges = []*utils.Edge{}
+	return node.clearSpill()
 }
 
-func (node *NodeData) AddEdges(edges []*utils.Edge) {
+func (node *NodeData) AddEdges(edges []*utils.Edge) error {
 	node.edgesMutex.Lock()
 	defer node.edgesMutex.Unlock()
 
+	node.fragmentsMutex.Lock()
+	defer node.fragmentsMutex.Unlock()
+
 	node.edges = append(node.edges, edges...)
+	return node.enforceBudget()
+}
+
+// keeps only the edges of the local minimum spanning forest, returning the number
+// of edges dropped
+func (node *NodeData) FilterEdges() (int, error) {
+	node.edgesMutex.Lock()
+	defer node.edgesMutex.Unlock()
+
+	node.fragmentsMutex.Lock()
+	defer node.fragmentsMutex.Unlock()
+
+	edges, err := node.loadEdges()
+	if err != nil {
+		return 0, err
+	}
+
+	forest := utils.GetLocalMSF(edges, node.fragments)
+	node.pruneFragments(forest)
+	return len(edges) - len(forest), node.setEdges(forest)
+}
+
+// drops self-loops and parallel edges between fragments (after a relabel), returning
+// the number of edges freed
+func (node *NodeData) ContractEdges() (int, error) {
+	node.edgesMutex.Lock()
+	defer node.edgesMutex.Unlock()
+
+	node.fragmentsMutex.Lock()
+	defer node.fragmentsMutex.Unlock()
+
+	edges, err := node.loadEdges()
+	if err != nil {
+		return 0, err
+	}
+
+	contracted := utils.ContractEdges(edges, node.fragments)
+	node.pruneFragments(contracted)
+	return len(edges) - len(contracted), node.setEdges(contracted)
+}
+
+// forgets the fragments of vertices not on any of the given edges. The caller must
+// hold the fragments mutex.
+func (node *NodeData) pruneFragments(edges []*utils.Edge) {
+	vertices := make(map[int32]bool)
+	for _, edge := range edges {
+		vertices[edge.U] = true
+		vertices[edge.V] = true
+	}
+
+	for vertex := range node.fragments {
+		if !vertices[vertex] {
+			delete(node.fragments, vertex)
+		}
+	}
 }
 
 func (node *NodeData) ClearFragments() {
@@ -178,21 +314,55 @@ func (node *NodeData) ClearFragments() {
 	node.fragments = make(map[int32]int32)
 }
 
-func (node *NodeData) UpdateFragment(vertex, id int32) {
+func (node *NodeData) UpdateFragments(fragments map[int32]int32) error {
+	node.edgesMutex.Lock()
+	defer node.edgesMutex.Unlock()
+
+	node.fragmentsMutex.Lock()
+	defer node.fragmentsMutex.Unlock()
+
+	for vertex, id := range fragments {
+		node.fragments[vertex] = id
+	}
+	return node.enforceBudget()
+}
+
+// relabels every vertex whose fragment is in the given (flattened) update
+func (node *NodeData) RelabelFragments(updates map[int32]int32) {
 	node.fragmentsMutex.Lock()
 	defer node.fragmentsMutex.Unlock()
 
-	node.fragments[vertex] = id
+	for vertex, frag := range node.fragments {
+		trgFrag, ok := updates[frag]
+		if !ok {
+			continue
+		}
+		log.Printf("----> updating node %d from %d to %d", vertex, frag, trgFrag)
+		node.fragments[vertex] = trgFrag
+	}
 }
 
 type NodeDataGenerator struct {
 	idCounterMutex sync.Mutex
 	idCounter      int32
+	budget         *NodeBudget
+
+	// if set, nodes are assigned the address host:basePort+id instead of
+	// listening on a random port, to be served by separate processes
+	host     string
+	basePort int
+	// if set, nodes are assigned the address mem-<id> instead of listening on a
+	// port, for transports that never leave the process
+	inMemory bool
 }
 
-func NewNodeDataGenerator() *NodeDataGenerator {
+func NewNodeDataGenerator(budget *NodeBudget, host string, basePort int, inMemory bool) *NodeDataGenerator {
 	return &NodeDataGenerator{
 		idCounter: 0,
+		budget:    budget,
+		host:      host,
+		basePort:  basePort,
+		inMemory:  inMemory,
 	}
 }
 
@@ -223,17 +393,46 @@ func (nodeGenerator *NodeDataGenerator) getNextId() (int32, error) {
 	return id, nil
 }
 
+// a node to take the place of node id in the tree, under an address of its own
+func (nodeGenerator *NodeDataGenerator) CreateStandby(id int32) (*NodeData, error) {
+	if nodeGenerator.basePort > 0 {
+		return nil, fmt.Errorf("standby nodes only run in a single process")
+	}
+	if nodeGenerator.inMemory {
+		// a node may be replaced more than once, so every standby is numbered
+		n, err := nodeGenerator.getNextId()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get next id: %v", err)
+		}
+		return NewNodeData(NewRemoteNodeMetaData(id, fmt.Sprintf("mem-standby-%d", n)), nodeGenerator.budget), nil
+	}
+
+	lis, err := listenOnRandomAddr()
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on random addr: %v", err)
+	}
+	return NewNodeData(NewNodeMetaData(id, lis), nodeGenerator.budget), nil
+}
+
 func (nodeGenerator *NodeDataGenerator) CreateNode() (*NodeData, error) {
 	id, err := nodeGenerator.getNextId()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get next id: %v", err)
 	}
 
+	if nodeGenerator.basePort > 0 {
+		addr := net.JoinHostPort(nodeGenerator.host, strconv.Itoa(nodeGenerator.basePort+int(id)))
+		return NewNodeData(NewRemoteNodeMetaData(id, addr), nodeGenerator.budget), nil
+	}
+	if nodeGenerator.inMemory {
+		return NewNodeData(NewRemoteNodeMetaData(id, fmt.Sprintf("mem-%d", id)), nodeGenerator.budget), nil
+	}
+
 	lis, err := listenOnRandomAddr()
 	if err != nil {
 		return nil, fmt.Errorf("failed to listen on random addr: %v", err)
 	}
 
-	node := NewNodeData(id, lis)
+	node := NewNodeData(NewNodeMetaData(id, lis), nodeGenerator.budget)
 	return node, nil
 }
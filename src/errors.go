@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	comms "mst/sublinear/comms"
+)
+
+// the failure of a single node, which travels up to the root and aborts the run
+type NodeError struct {
+	NodeId int32
+	Phase  int32
+	Reason string
+}
+
+func (e *NodeError) Error() string {
+	return fmt.Sprintf("node %d failed in phase %d: %s", e.NodeId, e.Phase, e.Reason)
+}
+
+func (e *NodeError) toProto() *comms.Failure {
+	return &comms.Failure{NodeId: e.NodeId, Phase: e.Phase, Reason: e.Reason}
+}
+
+func nodeErrorFromProto(failure *comms.Failure) *NodeError {
+	return &NodeError{NodeId: failure.GetNodeId(), Phase: failure.GetPhase(), Reason: failure.GetReason()}
+}
+
+// a node gave up because of a failure elsewhere in the tree, which it learnt of from
+// above (its parent, or the context shared by the nodes of a process). It is not
+// reported back up.
+type abortedError struct {
+	cause *NodeError
+}
+
+func (e *abortedError) Error() string {
+	return fmt.Sprintf("aborted: %v", e.cause)
+}
+
+func (e *abortedError) Unwrap() error {
+	return e.cause
+}
+
+// the failure behind the errors of a run: the first node error, if there is one
+func firstFailure(errs []error) error {
+	for _, err := range errs {
+		var nodeErr *NodeError
+		if errors.As(err, &nodeErr) {
+			return nodeErr
+		}
+	}
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// the failures of the nodes of a process. They share a context, so the first to fail
+// takes down the others.
+type runFailures struct {
+	mutex  sync.Mutex
+	errs   []error
+	cancel context.CancelCauseFunc
+}
+
+func newRunFailures(cancel context.CancelCauseFunc) *runFailures {
+	return &runFailures{cancel: cancel}
+}
+
+// notes the failure of a node, and aborts the others with it
+func (f *runFailures) add(err error, nodeErr *NodeError) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.errs = append(f.errs, err)
+	f.cancel(&abortedError{cause: nodeErr})
+}
+
+// notes what the server of a node returned, if it failed. A crashed node goes quiet,
+// and is left for its parent to find out about.
+func (f *runFailures) addServer(server *SubLinearServer, err error) {
+	if err == nil || errors.Is(err, errCrashed) {
+		return
+	}
+	var nodeErr *NodeError
+	if !errors.As(err, &nodeErr) {
+		nodeErr = &NodeError{NodeId: server.nodeData.md.id, Phase: server.nodeData.md.phase, Reason: err.Error()}
+	}
+	f.add(err, nodeErr)
+}
+
+func (f *runFailures) first() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return firstFailure(f.errs)
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	comms "mst/sublinear/comms"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+type FaultAction int
+
+const (
+	DelayFault FaultAction = iota
+	DropFault
+	DuplicateFault
+	CorruptFault
+)
+
+func (action FaultAction) String() string {
+	switch action {
+	case DropFault:
+		return "drop"
+	case DuplicateFault:
+		return "duplicate"
+	case CorruptFault:
+		return "corrupt"
+	}
+	return "delay"
+}
+
+func ParseFaultAction(action string) (FaultAction, error) {
+	switch action {
+	case "delay":
+		return DelayFault, nil
+	case "drop":
+		return DropFault, nil
+	case "duplicate":
+		return DuplicateFault, nil
+	case "corrupt":
+		return CorruptFault, nil
+	}
+	return DelayFault, fmt.Errorf("unknown fault %q, expected delay, drop, duplicate or corrupt", action)
+}
+
+// a single line of a fault policy, applied to the PropogateUp messages it matches
+type faultRule struct {
+	line   int
+	action FaultAction
+	// on the way out of the child, or on the way into the parent
+	atServer bool
+	// the sender and phase of the messages it matches, -1 for any
+	node  int32
+	phase int32
+	// if set, only the nth message it matches is hit, otherwise each one is with
+	// probability prob
+	nth  int
+	prob float64
+	// how long a delay lasts
+	delay time.Duration
+
+	// the distinct messages matched so far, as a retry or a duplicate of a message
+	// is not another one
+	seen map[deliveryKey]bool
+}
+
+func (rule *faultRule) String() string {
+	at := "client"
+	if rule.atServer {
+		at = "server"
+	}
+	return fmt.Sprintf("%s at %s (line %d)", rule.action, at, rule.line)
+}
+
+// the faults to inject into the PropogateUp calls of a run, read from a policy file
+// of one rule per line, as in:
+//
+//	seed 7
+//	drop node=7 phase=2 nth=3
+//	delay prob=0.1 for=200ms at=server
+//
+// Every rule names an action (delay, drop, duplicate or corrupt), and may narrow it
+// down to a sender, a phase, the nth message it matches or a share of them. Rules
+// hit at the client by default. The nth message is counted by sender, phase and
+// chunk, so it is hit once, and its retries go through. With a share, every attempt
+// may be hit. Given the same seed and the same order of messages, the same messages
+// are hit.
+type FaultPolicy struct {
+	mutex sync.Mutex
+	rng   *rand.Rand
+	rules []*faultRule
+}
+
+func ReadFaultPolicy(fileName string) (*FaultPolicy, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fault policy: %v", err)
+	}
+	defer file.Close()
+
+	seed := int64(42)
+	policy := &FaultPolicy{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(strings.SplitN(scanner.Text(), "#", 2)[0])
+		if len(fields) == 0 {
+			continue
+		}
+
+		if fields[0] == "seed" {
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("%s:%d: expected seed <n>", fileName, line)
+			}
+			if seed, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid seed: %v", fileName, line, err)
+			}
+			continue
+		}
+
+		rule, err := parseFaultRule(line, fields)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", fileName, line, err)
+		}
+		policy.rules = append(policy.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read fault policy: %v", err)
+	}
+
+	policy.rng = rand.New(rand.NewSource(seed))
+	return policy, nil
+}
+
+func parseFaultRule(line int, fields []string) (*faultRule, error) {
+	action, err := ParseFaultAction(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	rule := &faultRule{line: line, action: action, node: -1, phase: -1, prob: 1, seen: make(map[deliveryKey]bool)}
+
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected key=value, got %q", field)
+		}
+
+		var err error
+		switch key {
+		case "node", "phase":
+			var n int64
+			n, err = strconv.ParseInt(value, 10, 32)
+			if key == "node" {
+				rule.node = int32(n)
+			} else {
+				rule.phase = int32(n)
+			}
+		case "nth":
+			rule.nth, err = strconv.Atoi(value)
+			if err == nil && rule.nth < 1 {
+				err = fmt.Errorf("counts from 1")
+			}
+		case "prob":
+			rule.prob, err = strconv.ParseFloat(value, 64)
+			if err == nil && (rule.prob < 0 || rule.prob > 1) {
+				err = fmt.Errorf("not between 0 and 1")
+			}
+		case "for":
+			rule.delay, err = time.ParseDuration(value)
+		case "at":
+			if value != "client" && value != "server" {
+				err = fmt.Errorf("expected client or server")
+			}
+			rule.atServer = value == "server"
+		default:
+			return nil, fmt.Errorf("unknown key %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", key, value, err)
+		}
+	}
+
+	if rule.action == DelayFault && rule.delay == 0 {
+		return nil, fmt.Errorf("delay needs for=<duration>")
+	}
+	return rule, nil
+}
+
+// the rules that hit the message, on the given side of the call
+func (policy *FaultPolicy) hits(atServer bool, edges *comms.Edges) []*faultRule {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	hits := []*faultRule{}
+	for _, rule := range policy.rules {
+		if rule.atServer != atServer ||
+			(rule.node >= 0 && rule.node != edges.GetSrcId()) ||
+			(rule.phase >= 0 && rule.phase != edges.GetPhase()) {
+			continue
+		}
+
+		if rule.nth > 0 {
+			key := deliveryKey{srcId: edges.GetSrcId(), phase: edges.GetPhase(), chunk: edges.GetChunk()}
+			if rule.seen[key] {
+				continue
+			}
+			rule.seen[key] = true
+			if len(rule.seen) != rule.nth {
+				continue
+			}
+		}
+		if rule.prob < 1 && policy.rng.Float64() >= rule.prob {
+			continue
+		}
+		hits = append(hits, rule)
+	}
+	return hits
+}
+
+// flips a random bit of the message as it would travel, as a bad link might. The
+// parent finds it does not match its checksum, and the child sends it again. A flip
+// that leaves it unreadable fails the call the same way.
+func (policy *FaultPolicy) corrupt(edges *comms.Edges) (*comms.Edges, error) {
+	// the same seed flips the same bit of the same message, whatever the order of
+	// its maps
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(edges)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return edges, nil
+	}
+
+	policy.mutex.Lock()
+	bit := policy.rng.Intn(8 * len(data))
+	policy.mutex.Unlock()
+	data[bit/8] ^= 1 << (bit % 8)
+
+	corrupted := &comms.Edges{}
+	if err := proto.Unmarshal(data, corrupted); err != nil {
+		return nil, status.Errorf(codes.DataLoss, "fault injection: corrupted beyond reading: %v", err)
+	}
+	return corrupted, nil
+}
+
+func logFault(rule *faultRule, edges *comms.Edges) {
+	log.Printf("[WARN] %d - fault: %s, on chunk %d of phase %d", edges.GetSrcId(), rule, edges.GetChunk(), edges.GetPhase())
+}
+
+// waits out a delay, or gives up with ctx
+func sleepFault(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// hits the PropogateUp calls of a child on their way out. A dropped call never
+// reaches the parent, and a duplicated one reaches it twice.
+func (policy *FaultPolicy) UnaryClientInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	edges, ok := req.(*comms.Edges)
+	if method != comms.EdgeDataService_PropogateUp_FullMethodName || !ok {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+
+	duplicate := false
+	for _, rule := range policy.hits(false, edges) {
+		logFault(rule, edges)
+		switch rule.action {
+		case DelayFault:
+			if err := sleepFault(ctx, rule.delay); err != nil {
+				return err
+			}
+		case DropFault:
+			return status.Errorf(codes.Unavailable, "fault injection: dropped on the way to the parent")
+		case DuplicateFault:
+			duplicate = true
+		case CorruptFault:
+			corrupted, err := policy.corrupt(edges)
+			if err != nil {
+				return err
+			}
+			req = corrupted
+		}
+	}
+
+	if duplicate {
+		// the parent answers the first copy too, but only the reply to the second
+		// comes back
+		if err := invoker(ctx, method, req, &comms.Update{}, cc, opts...); err != nil {
+			return err
+		}
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// hits the PropogateUp calls of the children as they come in. A dropped call is
+// handled, but its reply is lost on the way back, and a duplicated one is handled
+// twice.
+func (policy *FaultPolicy) UnaryServerInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	edges, ok := req.(*comms.Edges)
+	if info.FullMethod != comms.EdgeDataService_PropogateUp_FullMethodName || !ok {
+		return handler(ctx, req)
+	}
+
+	drop, duplicate := false, false
+	for _, rule := range policy.hits(true, edges) {
+		logFault(rule, edges)
+		switch rule.action {
+		case DelayFault:
+			if err := sleepFault(ctx, rule.delay); err != nil {
+				return nil, err
+			}
+		case DropFault:
+			drop = true
+		case DuplicateFault:
+			duplicate = true
+		case CorruptFault:
+			corrupted, err := policy.corrupt(edges)
+			if err != nil {
+				return nil, err
+			}
+			req = corrupted
+		}
+	}
+
+	if duplicate {
+		if _, err := handler(ctx, req); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := handler(ctx, req)
+	if drop && err == nil {
+		return nil, status.Errorf(codes.Unavailable, "fault injection: reply dropped on the way to the child")
+	}
+	return reply, err
+}
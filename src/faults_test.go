@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	comms "mst/sublinear/comms"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func writePolicy(t *testing.T, policy string) string {
+	fileName := filepath.Join(t.TempDir(), "policy.faults")
+	if err := os.WriteFile(fileName, []byte(policy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestParseFaultRule(t *testing.T) {
+	cases := []struct {
+		line     string
+		expected faultRule
+	}{
+		{"drop", faultRule{action: DropFault, node: -1, phase: -1, prob: 1}},
+		{"drop node=7 phase=2 nth=3", faultRule{action: DropFault, node: 7, phase: 2, nth: 3, prob: 1}},
+		{"delay for=200ms prob=0.05 at=server", faultRule{action: DelayFault, atServer: true, node: -1, phase: -1, prob: 0.05, delay: 200 * time.Millisecond}},
+		{"duplicate phase=0 at=client", faultRule{action: DuplicateFault, node: -1, phase: 0, prob: 1}},
+		{"corrupt node=3", faultRule{action: CorruptFault, node: 3, phase: -1, prob: 1}},
+	}
+	for _, tc := range cases {
+		rule, err := parseFaultRule(1, strings.Fields(tc.line))
+		if err != nil {
+			t.Fatalf("%q: %v", tc.line, err)
+		}
+		if rule.action != tc.expected.action || rule.atServer != tc.expected.atServer || rule.node != tc.expected.node ||
+			rule.phase != tc.expected.phase || rule.nth != tc.expected.nth || rule.prob != tc.expected.prob || rule.delay != tc.expected.delay {
+			t.Fatalf("%q: got %+v, expected %+v", tc.line, *rule, tc.expected)
+		}
+	}
+
+	for _, line := range []string{
+		"explode",
+		"drop node",
+		"drop node=x",
+		"drop nth=0",
+		"drop prob=1.5",
+		"delay",
+		"delay for=soon",
+		"drop at=both",
+		"drop colour=red",
+	} {
+		if _, err := parseFaultRule(1, strings.Fields(line)); err == nil {
+			t.Fatalf("%q: expected the rule to be turned down", line)
+		}
+	}
+}
+
+func TestReadFaultPolicy(t *testing.T) {
+	policy, err := ReadFaultPolicy(writePolicy(t, `
+# a comment
+seed 7
+
+drop node=7 phase=2 nth=3   # the third
+delay for=1s prob=0.5
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policy.rules) != 2 || policy.rules[0].line != 5 || policy.rules[1].line != 6 {
+		t.Fatalf("got rules %v, expected those of lines 5 and 6", policy.rules)
+	}
+
+	for policyText, expected := range map[string]string{
+		"seed":                     ":1: expected seed <n>",
+		"seed x":                   ":1: invalid seed",
+		"drop\ndrop nth=-1":        ":2: invalid nth",
+		"\n\ncorrupt at=somewhere": ":3: invalid at",
+	} {
+		_, err := ReadFaultPolicy(writePolicy(t, policyText))
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("%q: got %v, expected an error containing %q", policyText, err, expected)
+		}
+	}
+
+	if _, err := ReadFaultPolicy(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatal("expected a missing policy to fail")
+	}
+}
+
+// the messages of a few children over a few phases, each sent twice as a retry would
+func faultMessages() []*comms.Edges {
+	messages := []*comms.Edges{}
+	for phase := int32(0); phase < 4; phase++ {
+		for srcId := int32(0); srcId < 5; srcId++ {
+			msg := randomEdgesMessage(5, int64(10*phase+srcId))
+			msg.SrcId, msg.Phase = srcId, phase
+			messages = append(messages, msg, msg)
+		}
+	}
+	return messages
+}
+
+// what the policy does to the messages, one line per message
+func applyPolicy(t *testing.T, policy *FaultPolicy) []string {
+	got := []string{}
+	for _, msg := range faultMessages() {
+		line := []string{}
+		for _, rule := range policy.hits(false, msg) {
+			line = append(line, rule.String())
+			if rule.action == CorruptFault {
+				corrupted, err := policy.corrupt(msg)
+				if err != nil {
+					line = append(line, status.Code(err).String())
+				} else {
+					line = append(line, corrupted.String())
+				}
+			}
+		}
+		got = append(got, strings.Join(line, ", "))
+	}
+	return got
+}
+
+// the same seed hits the same messages, and flips the same bits
+func TestFaultPolicySeeded(t *testing.T) {
+	policyText := "seed %d\ndrop prob=0.3\ncorrupt prob=0.2\nduplicate node=2 nth=3\n"
+	runs := [][]string{}
+	for _, seed := range []int{7, 7, 8} {
+		policy, err := ReadFaultPolicy(writePolicy(t, strings.Replace(policyText, "%d", strconv.Itoa(seed), 1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		runs = append(runs, applyPolicy(t, policy))
+	}
+
+	if strings.Join(runs[0], "\n") != strings.Join(runs[1], "\n") {
+		t.Fatal("expected the same seed to hit the same messages")
+	}
+	if strings.Join(runs[0], "\n") == strings.Join(runs[2], "\n") {
+		t.Fatal("expected another seed to hit other messages")
+	}
+}
+
+// nth counts distinct messages, so the retries of the one it hits go through
+func TestFaultNthCountsDistinct(t *testing.T) {
+	policy, err := ReadFaultPolicy(writePolicy(t, "drop node=2 nth=2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hit := []int{}
+	for i, msg := range faultMessages() {
+		if len(policy.hits(false, msg)) > 0 {
+			hit = append(hit, i)
+		}
+	}
+	// node 2 sends messages 4 and 5 in phase 0, and 14 and 15 in phase 1
+	if len(hit) != 1 || hit[0] != 14 {
+		t.Fatalf("got messages %v hit, expected only the first of node 2 in phase 1", hit)
+	}
+}
+
+// the parent turns down edges that do not match the checksum they were sent with
+func TestVerifyChecksum(t *testing.T) {
+	msg := randomEdgesMessage(20, 3)
+	info := &grpc.UnaryServerInfo{FullMethod: comms.EdgeDataService_PropogateUp_FullMethodName}
+	handled := 0
+	handler := func(ctx context.Context, req any) (any, error) {
+		handled++
+		return &comms.Update{}, nil
+	}
+
+	// the checksum the child sends, as it arrives at the parent
+	var incoming context.Context
+	invoker := func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ := metadata.FromOutgoingContext(ctx)
+		incoming = metadata.NewIncomingContext(context.Background(), md)
+		return nil
+	}
+	if err := checksumUnaryClient(context.Background(), info.FullMethod, msg, &comms.Update{}, nil, invoker); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := verifyChecksumUnary(incoming, proto.Clone(msg), info, handler); err != nil || handled != 1 {
+		t.Fatalf("got %v, expected the edges to be taken", err)
+	}
+
+	corrupted := proto.Clone(msg).(*comms.Edges)
+	corrupted.Edges[4].Weight ^= 1 << 3
+	_, err := verifyChecksumUnary(incoming, corrupted, info, handler)
+	if status.Code(err) != codes.DataLoss || handled != 1 {
+		t.Fatalf("got %v, expected the corrupted edges to be turned down", err)
+	}
+
+	// edges sent without a checksum are taken as they are
+	if _, err := verifyChecksumUnary(context.Background(), corrupted, info, handler); err != nil || handled != 2 {
+		t.Fatalf("got %v, expected edges without a checksum to be taken", err)
+	}
+}
+
+// corrupted, dropped and duplicated edges are all caught, and sent again
+func TestCalcMSTChaos(t *testing.T) {
+	graphFile := writeRandomGraph(t, 60, 400, 11)
+	policyFile := writePolicy(t, `
+seed 3
+corrupt phase=0 nth=1
+corrupt phase=1 nth=2 at=server
+corrupt prob=0.05
+drop phase=0 nth=3
+drop phase=2 nth=1 at=server
+duplicate prob=0.1
+`)
+
+	outFile := runTransport(t, graphFile, "bufconn", "-faults", policyFile, "-retry-backoff", "1ms", "-retries", "10")
+	if err := checkForest(graphFile, outFile); err != nil {
+		t.Fatal(err)
+	}
+}
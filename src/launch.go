@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// the number of trailing log lines of a failed worker to report
+const failedLogLines = 10
+
+type workerResult struct {
+	id      int32
+	logFile string
+	err     error
+}
+
+// the last few lines of a log file, to give a failure some context
+func tailLog(fileName string, numLines int) string {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return fmt.Sprintf("<failed to read log: %v>", err)
+	}
+
+	lines := bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n"))
+	lines = lines[max(0, len(lines)-numLines):]
+	return string(bytes.Join(lines, []byte("\n")))
+}
+
+// runs one worker process per node of the manifest on this machine, each logging
+// to its own file in dir. If any worker fails, every other worker is killed.
+func superviseWorkers(manifestFile, dir string) error {
+	manifest, err := ReadManifest(manifestFile)
+	if err != nil {
+		return fmt.Errorf("failed to read manifest: %v", err)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find executable: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := make(chan workerResult, len(manifest.Nodes))
+	for _, node := range manifest.Nodes {
+		logFile := filepath.Join(dir, fmt.Sprintf("node-%d.log", node.Id))
+		out, err := os.Create(logFile)
+		if err != nil {
+			return fmt.Errorf("failed to create log file: %v", err)
+		}
+
+		cmd := exec.CommandContext(ctx, executable, "worker", "-manifest", manifestFile, "-id", strconv.Itoa(int(node.Id)))
+		cmd.Stdout = out
+		cmd.Stderr = out
+		if err := cmd.Start(); err != nil {
+			out.Close()
+			return fmt.Errorf("failed to start worker %d: %v", node.Id, err)
+		}
+		log.Printf("started worker %d (pid %d) on %s, logging to %s", node.Id, cmd.Process.Pid, node.Addr, logFile)
+
+		go func(id int32) {
+			defer out.Close()
+			results <- workerResult{id: id, logFile: logFile, err: cmd.Wait()}
+		}(node.Id)
+	}
+
+	var failure *workerResult
+	for range manifest.Nodes {
+		result := <-results
+		if result.err == nil || failure != nil {
+			continue
+		}
+
+		// the first failure takes every other worker down with it
+		failure = &result
+		log.Printf("[ERROR] worker %d failed: %v, killing every other worker", result.id, result.err)
+		cancel()
+	}
+
+	if failure != nil {
+		return fmt.Errorf("worker %d failed: %v, last lines of %s:\n%s",
+			failure.id, failure.err, failure.logFile, tailLog(failure.logFile, failedLogLines))
+	}
+
+	return nil
+}
+
+func launchMain(args []string) {
+	fs := flag.NewFlagSet("launch", flag.ExitOnError)
+	buildConfig := addRunFlags(fs)
+	dir := fs.String("dir", "", "directory for the manifest, leaf edges and worker logs (default: a new temporary directory)")
+	basePort := fs.Int("base-port", 50051, "port of node 0, node i listens on base-port+i")
+	fs.Usage = func() {
+		fmt.Println("usage: go run *.go launch [flags] <infile> <outfile> <alpha>")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	infile, outfile, alpha := parseRunArgs(fs)
+	cfg, err := buildConfig(alpha)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	cfg.host = "127.0.0.1"
+	cfg.basePort = *basePort
+
+	workDir := *dir
+	if workDir == "" {
+		workDir, err = os.MkdirTemp("", "mst-cluster-")
+		if err != nil {
+			log.Fatalf("[ERROR] failed to create work dir: %v", err)
+		}
+	} else if err := os.MkdirAll(workDir, 0755); err != nil {
+		log.Fatalf("[ERROR] failed to create work dir: %v", err)
+	}
+	log.Printf("work dir  : %s", workDir)
+
+	manifestFile := filepath.Join(workDir, "manifest.json")
+	manifest, err := runCoordinator(infile, outfile, manifestFile, cfg)
+	if err != nil {
+		log.Fatalf("[ERROR] failed to coordinate: %v", err)
+	}
+
+	// certificates are generated on the first run, and reused after for as long as
+	// they cover every node
+	if manifest.CertsDir != "" {
+		ids := []int32{}
+		missing := false
+		for _, node := range manifest.Nodes {
+			ids = append(ids, node.Id)
+			if _, err := os.Stat(filepath.Join(manifest.CertsDir, nodeName(node.Id)+".pem")); err != nil {
+				missing = true
+			}
+		}
+		if missing {
+			if err := generateCerts(manifest.CertsDir, ids); err != nil {
+				log.Fatalf("[ERROR] failed to generate certificates: %v", err)
+			}
+			log.Printf("generated certificates for %d nodes in %s", len(ids), manifest.CertsDir)
+		}
+	}
+
+	if err := superviseWorkers(manifestFile, workDir); err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
+	stats(infile, outfile)
+}
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"math"
@@ -8,6 +13,7 @@ import (
 	"slices"
 	"strconv"
 	"sync"
+	"time"
 
 	utils "mst/sublinear/utils"
 )
@@ -35,13 +41,185 @@ func (md *GraphMetaData) NumEdgesPerNode() int32 {
 	return int32(math.Floor(md.S()))
 }
 
-func createTree(edges []*utils.Edge, md *GraphMetaData) ([]*NodeData, error) {
-	nodeGenerator := NewNodeDataGenerator()
+// the default memory budget of a node: enough words for a leaf to hold its S edges
+// along with the fragment ids of their endpoints
+func (md *GraphMetaData) DefaultBudget() int {
+	return int(md.NumEdgesPerNode()) * (wordsPerEdge + 2*wordsPerFragment)
+}
 
-	numNodes := int(math.Ceil(float64(len(edges)) / float64(md.NumEdgesPerNode())))
-	nodeEdgesList, err := utils.Partition(edges, numNodes)
-	if err != nil {
-		return nil, fmt.Errorf("failed to partition edges: %v", err)
+// the default number of children per parent, and the most picked to fit a budget.
+// With sqrt(S) children, the tree over the m/S leaves has a depth of O(1/alpha).
+func (md *GraphMetaData) DefaultFanOut() int {
+	return max(2, int(math.Floor(math.Sqrt(md.S()))))
+}
+
+// the largest fan-out up to maxFanOut whose tree fits the budget, or maxFanOut if
+// none does
+func fitFanOut(partitions [][]*utils.Edge, maxFanOut int, words int) int {
+	for fanOut := maxFanOut; fanOut >= 2; fanOut-- {
+		if treeBudget(partitions, fanOut) <= words {
+			return fanOut
+		}
+	}
+	return maxFanOut
+}
+
+// options of a run, set from the command line
+type RunConfig struct {
+	alpha float64
+	// children per parent in the aggregation tree, 0 to derive it from S and the budget
+	fanOut int
+	// fail, instead of warning, when a parent receives more than S words in a phase
+	strictWordLimit bool
+	// memory budget of a node in words, 0 to derive it from S
+	budget       int
+	budgetPolicy BudgetPolicy
+	spillDir     string
+	// how the edges are split between the leaves
+	partitionStrategy string
+	partitioner       utils.Partitioner
+	// if set, nodes are assigned host:basePort+id to be run as separate workers
+	host     string
+	basePort int
+	// how the nodes of an in-process run talk to each other: grpc, channel or bufconn
+	transport string
+	// send edges up over a single stream per child, instead of a call per phase
+	stream bool
+	// hard cap on the words of a single message, 0 to derive it from S
+	maxMessageWords int
+	// offer the packed encoding between parents and children
+	packed bool
+	// if set, nodes talk over mutual TLS with the certificates in this directory
+	certsDir string
+	// how often a child retries a call to its parent that failed on the way, and the
+	// wait before the first retry, doubled for every one after
+	retries      int
+	retryBackoff time.Duration
+	// if set, every node writes its state to this directory at the start of each
+	// phase, and a resumed run starts from the last phase they all started
+	checkpointDir string
+	resume        bool
+	// how often children send heartbeats to their parent (0 for none), how long a
+	// parent waits on a silent child, and what it does about a dead one
+	heartbeat       time.Duration
+	deadAfter       time.Duration
+	deadChildPolicy DeadChildPolicy
+	standbys        int
+	// for testing, the leaf to crash and the phase to crash it in
+	crash      bool
+	crashId    int32
+	crashPhase int32
+	// if set, the run exits with a dump of every node to watchdogFile when no node
+	// progresses its phase for this long
+	watchdog     time.Duration
+	watchdogFile string
+	// if set, faults are injected into the PropogateUp calls as the policy in
+	// faultsFile says
+	faultsFile string
+	faults     *FaultPolicy
+}
+
+// the number of leaves, each starting out with S edges
+func (md *GraphMetaData) NumLeaves() int {
+	return int(math.Ceil(float64(md.edges) / float64(md.NumEdgesPerNode())))
+}
+
+// gives a leaf its edges, with every vertex in a fragment of its own
+func initLeaf(node *NodeData, edges []*utils.Edge) error {
+	if err := node.AddEdges(edges); err != nil {
+		return fmt.Errorf("failed to add edges: %v", err)
+	}
+
+	fragments := make(map[int32]int32)
+	for _, edge := range edges {
+		for _, vertex := range []int32{edge.U, edge.V} {
+			fragments[vertex] = vertex
+		}
+	}
+	if err := node.UpdateFragments(fragments); err != nil {
+		return fmt.Errorf("failed to add fragments: %v", err)
+	}
+
+	return nil
+}
+
+// groups the nodes of every level under parents of fanOut children, from the leaves
+// up to a single root
+func groupLevels[T any](leaves []T, fanOut int, newParent func(children []T) (T, error)) error {
+	queue := make([]T, len(leaves))
+	copy(queue, leaves)
+
+	for len(queue) > 1 {
+		level := queue
+		queue = []T{}
+
+		for len(level) > 0 {
+			// a lone leftover node is not worth a parent, move it up a level as is
+			if len(level) == 1 {
+				queue = append(queue, level[0])
+				break
+			}
+
+			numChildren := min(fanOut, len(level))
+			children := level[:numChildren]
+			level = level[numChildren:]
+
+			parent, err := newParent(children)
+			if err != nil {
+				return err
+			}
+			// to continue the upward level order traversal
+			queue = append(queue, parent)
+		}
+	}
+	return nil
+}
+
+// the most words any node of a tree of the given fan-out over the partitions may
+// hold in a phase. A leaf holds its edges and the fragment ids of their endpoints. A
+// node sends at most one edge per fragment of its subtree, along with the fragment
+// ids of their endpoints, and a parent holds no more than its children send it.
+func treeBudget(partitions [][]*utils.Edge, fanOut int) int {
+	// a subtree, as far as the words it may send go
+	type subtree struct {
+		edges    int
+		vertices map[int32]bool
+	}
+	sends := func(sub subtree) int {
+		return wordsPerEdge*min(sub.edges, len(sub.vertices)) + wordsPerFragment*len(sub.vertices)
+	}
+
+	budget := 0
+	leaves := []subtree{}
+	for _, edges := range partitions {
+		leaf := subtree{edges: len(edges), vertices: make(map[int32]bool)}
+		for _, edge := range edges {
+			leaf.vertices[edge.U] = true
+			leaf.vertices[edge.V] = true
+		}
+		budget = max(budget, wordsPerEdge*leaf.edges+wordsPerFragment*len(leaf.vertices))
+		leaves = append(leaves, leaf)
+	}
+
+	_ = groupLevels(leaves, fanOut, func(children []subtree) (subtree, error) {
+		parent := subtree{vertices: make(map[int32]bool)}
+		received := 0
+		for _, child := range children {
+			received += sends(child)
+			parent.edges += child.edges
+			for vertex := range child.vertices {
+				parent.vertices[vertex] = true
+			}
+		}
+		budget = max(budget, received)
+		return parent, nil
+	})
+	return budget
+}
+
+func createTree(nodeEdgesList [][]*utils.Edge, fanOut int, nodeGenerator *NodeDataGenerator) ([]*NodeData, error) {
+	if fanOut < 2 {
+		return nil, fmt.Errorf("fan-out must be at least 2, got %d", fanOut)
 	}
 
 	nodes := []*NodeData{}
@@ -52,110 +230,360 @@ func createTree(edges []*utils.Edge, md *GraphMetaData) ([]*NodeData, error) {
 			return nil, fmt.Errorf("failed to create node: %v", err)
 		}
 
-		node.AddEdges(nodeEdges)
-		for _, edge := range nodeEdges {
-			for _, vertex := range []int32{edge.U, edge.V} {
-				node.UpdateFragment(vertex, vertex)
-			}
+		if err := initLeaf(node, nodeEdges); err != nil {
+			return nil, err
 		}
 
 		nodes = append(nodes, node)
 	}
 
 	// kind of a reverse level order traversal to build a tree from leaves
+	err := groupLevels(nodes, fanOut, func(children []*NodeData) (*NodeData, error) {
+		parent, err := nodeGenerator.CreateNode()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create parent node: %v", err)
+		}
+
+		childrenData := []*NodeMetaData{}
+		for _, child := range children {
+			childrenData = append(childrenData, child.md)
+		}
 
-	NUM_CHILDREN := 2
-	queue := make([]*NodeData, len(nodes))
-	copy(queue, nodes)
+		parent.md.SetChildren(childrenData)
+		for _, child := range children {
+			child.md.SetParent(parent.md)
+		}
 
-	for len(queue) > 1 {
-		numNodes := len(queue)
-		NUM_PARENTS := numNodes / NUM_CHILDREN
+		// add the node to the list
+		nodes = append(nodes, parent)
+		return parent, nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		for start := 0; start < NUM_PARENTS; start++ {
-			children := queue[:NUM_CHILDREN]
-			queue = queue[NUM_CHILDREN:]
+	// NOTE: we start-up the servers in ROOT to LEAF order to ensure
+	// the servers are ready to receive messages
+	slices.Reverse(nodes)
+	return nodes, nil
+}
 
-			parent, err := nodeGenerator.CreateNode()
-			if err != nil {
-				return nil, fmt.Errorf("failed to create parent node: %v", err)
-			}
+// the tree of nodes that computes the msf of a graph
+type Tree struct {
+	md             *GraphMetaData
+	nodes          []*NodeData
+	budget         *NodeBudget
+	partitionStats utils.PartitionStats
+	// the words a single message may hold, larger messages are sent in chunks
+	maxMessageWords int
+	// stamped on every message of the run
+	jobId string
+	// creates the nodes, and any that take their place later
+	generator *NodeDataGenerator
+}
 
-			childrenData := []*NodeMetaData{}
-			for _, child := range children {
-				childrenData = append(childrenData, child.md)
-			}
+// a random id for a run, so that its messages cannot be mistaken for another's
+func newJobId() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate job id: %v", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
 
-			parent.md.SetChildren(childrenData)
-			for _, child := range children {
-				child.md.SetParent(parent.md)
-			}
-			// to continue the upward level order traversal
-			queue = append(queue, parent)
+// reads the graph, partitions its edges between the leaves and builds the tree
+func buildTree(graphFile string, cfg *RunConfig) (*Tree, error) {
+	edges, err := utils.ReadGraph(graphFile)
+	if err != nil {
+		return nil, err
+	}
+	md := NewMetaData(edges, cfg.alpha)
+
+	nodeEdgesList, err := cfg.partitioner.Partition(edges, md.NumLeaves())
+	if err != nil {
+		return nil, fmt.Errorf("failed to partition edges: %v", err)
+	}
+
+	budget := &NodeBudget{words: cfg.budget, policy: cfg.budgetPolicy, spillDir: cfg.spillDir}
+	if budget.words == 0 {
+		budget.words = md.DefaultBudget()
+	}
+	log.Printf("budget    : %d words", budget.words)
+
+	// the widest tree whose parents can hold all their children may send them
+	fanOut := cfg.fanOut
+	if fanOut == 0 {
+		fanOut = fitFanOut(nodeEdgesList, md.DefaultFanOut(), budget.words)
+	}
+	log.Printf("fan-out   : %d", fanOut)
+	if need := treeBudget(nodeEdgesList, fanOut); need > budget.words {
+		log.Printf("[WARN] a node of the tree may need %d words, over the budget of %d, which the %s policy acts on", need, budget.words, budget.policy)
+	}
+
+	// a node sends and receives O(S) words a round, so by default a message holds no
+	// more than a leaf does
+	maxMessageWords := cfg.maxMessageWords
+	if maxMessageWords == 0 {
+		maxMessageWords = md.DefaultBudget()
+	}
+	log.Printf("message   : at most %d words", maxMessageWords)
+
+	jobId, err := newJobId()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("job       : %s", jobId)
+
+	inMemory := cfg.transport != "" && cfg.transport != "grpc"
+	nodeGenerator := NewNodeDataGenerator(budget, cfg.host, cfg.basePort, inMemory)
+	nodes, err := createTree(nodeEdgesList, fanOut, nodeGenerator)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tree: %v", err)
+	}
+
+	return &Tree{
+		md:             md,
+		nodes:          nodes,
+		budget:         budget,
+		partitionStats: utils.GetPartitionStats(nodeEdgesList),
+
+		maxMessageWords: maxMessageWords,
+		jobId:           jobId,
+		generator:       nodeGenerator,
+	}, nil
+}
+
+// runs a node to the end of the calculation. If the node fails, the failure is
+// reported up the tree and passed on to its children before it is returned. The
+// server keeps serving, for children that retry their last message.
+func runServer(server *SubLinearServer) error {
+	// heartbeats go up and children are watched for as long as the node runs
+	ctx, cancel := context.WithCancel(server.ctx)
+	defer cancel()
+	startLiveness(ctx, server)
+
+	var err error
+	if server.nodeData.md.isLeaf() {
+		err = server.leafDriver()
+	} else {
+		err = server.nonLeafDriver()
+	}
+	if errors.Is(err, errCrashed) {
+		return err
+	}
+	if err != nil {
+		return server.fail(err)
+	}
+	return nil
+}
 
-			// add the node to the list
-			nodes = append(nodes, parent)
+// stops the servers all at once, as a parent streaming with its children stops only
+// once they do
+func shutDownAll(servers []*SubLinearServer) {
+	wg := sync.WaitGroup{}
+	for _, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.ShutDown()
+		}()
+	}
+	wg.Wait()
+}
+
+// logs the traffic and the peak memory of the servers, at the end of a run
+func logSummary(servers []*SubLinearServer, wordLimit int32, budget *NodeBudget) {
+	violations := 0
+	for _, server := range servers {
+		violations += server.wordLimitViolations
+	}
+	if violations > 0 {
+		log.Printf("[WARN] parents received more than %d words in a phase %d times", wordLimit, violations)
+	}
+
+	totalWords := 0
+	for _, server := range servers {
+		totalWords += server.totalReceivedWords
+	}
+	log.Printf("===> parents received %d words in total", totalWords)
+
+	dials, reconnects := 0, 0
+	for _, server := range servers {
+		connStats := server.transport.ConnStats()
+		dials += connStats.Dials
+		reconnects += connStats.Reconnects
+	}
+	log.Printf("===> %d connections opened to parents, %d of them reconnects", dials, reconnects)
+
+	wireBytes, plainBytes := 0, 0
+	for _, server := range servers {
+		wireBytes += server.wireBytes
+		plainBytes += server.plainBytes
+	}
+	if plainBytes > 0 {
+		log.Printf("===> %d bytes sent between nodes, %d in the plain encoding (%.1f%%)", wireBytes, plainBytes,
+			100*float64(wireBytes)/float64(plainBytes))
+	}
+
+	exceeded := 0
+	for _, server := range servers {
+		peak := server.nodeData.PeakWords()
+		log.Printf("[INFO] node %d -> peak of %d words", server.nodeData.md.id, peak)
+		if peak > budget.words {
+			exceeded++
 		}
 	}
+	log.Printf("===> %d of %d nodes exceeded their budget of %d words", exceeded, len(servers), budget.words)
+}
 
-	// NOTE: we start-up the servers in ROOT to LEAF order to ensure
-	// the servers are ready to receive messages
-	slices.Reverse(nodes)
-	return nodes, nil
+// how much larger than the mean a partition may be before it is worth a warning
+const maxPartitionBalance = 2.0
+
+func logPartitionStats(strategy string, stats utils.PartitionStats) {
+	log.Printf("===> partition %s -> %d cut vertices, %d cut edges, %.2f replication, %.2f balance", strategy,
+		stats.CutVertices, stats.CutEdges, stats.Replication, stats.Balance)
+	if stats.EmptyPartitions > 0 {
+		log.Printf("[WARN] %d leaves were given no edges by the %s partition", stats.EmptyPartitions, strategy)
+	}
+	if stats.Balance > maxPartitionBalance {
+		log.Printf("[WARN] the largest partition holds %.2f times the mean, more than a leaf may hold", stats.Balance)
+	}
 }
 
-func calcMST(graphFile string, outFile string, alpha float64) error {
+func calcMST(graphFile string, outFile string, cfg *RunConfig) error {
 	log.Printf("graph file: %s", graphFile)
 	log.Printf("out   file: %s", outFile)
 
-	edges, err := utils.ReadGraph(graphFile)
+	tree, err := buildTree(graphFile, cfg)
 	if err != nil {
 		return err
 	}
-	md := NewMetaData(edges, alpha)
 
-	nodes, err := createTree(edges, md)
+	transportCfg := TransportConfig{stream: cfg.stream, maxMessageWords: tree.maxMessageWords, certsDir: cfg.certsDir, faults: cfg.faults}
+	newTransport, err := NewTransportFactory(cfg.transport, transportCfg)
 	if err != nil {
-		return fmt.Errorf("failed to create tree: %v", err)
+		return err
+	}
+	log.Printf("transport : %s (stream: %t, tls: %t)", cfg.transport, cfg.stream, cfg.certsDir != "")
+	if cfg.faults != nil {
+		log.Printf("faults    : %s", cfg.faultsFile)
 	}
 
+	// nodes done by the phase the run resumes from are not run again
+	done, err := prepareRun(tree, outFile, cfg)
+	if err != nil {
+		return err
+	}
+
+	// the nodes share a context, so the first to fail takes down the others
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	failures := newRunFailures(cancel)
+
 	serverWg := sync.WaitGroup{}
-	for _, node := range nodes {
-		// bind the server to a port
+	serversMutex := sync.Mutex{}
+	servers := []*SubLinearServer{}
+
+	// standbys are started as any other node, so this is set once startNode is
+	var liveness LivenessConfig
+
+	// creates the server of a node and runs it, in the background
+	startNode := func(node *NodeData, crash bool) error {
 		log.Printf("node: %s", node.String())
-		server, err := NewSubLinearServer(node, outFile)
+		transport, err := newTransport(node.md)
+		if err != nil {
+			return fmt.Errorf("failed to create transport: %v", err)
+		}
+		serverCfg := ServerConfig{
+			outFile:         partialFile(outFile),
+			wordLimit:       tree.md.NumEdgesPerNode(),
+			strictWordLimit: cfg.strictWordLimit,
+			maxMessageWords: tree.maxMessageWords,
+			packed:          cfg.packed,
+			jobId:           tree.jobId,
+			retries:         cfg.retries,
+			retryBackoff:    cfg.retryBackoff,
+			stream:          cfg.stream,
+			checkpointDir:   cfg.checkpointDir,
+			liveness:        liveness,
+			crash:           crash,
+			crashPhase:      cfg.crashPhase,
+		}
+		server, err := NewSubLinearServer(ctx, node, serverCfg, transport)
 		if err != nil {
-			log.Fatalf("failed to create server: %v", err)
+			return fmt.Errorf("failed to create server: %v", err)
 		}
+		serversMutex.Lock()
+		servers = append(servers, server)
+		serversMutex.Unlock()
 
-		// launch the server
 		serverWg.Add(1)
 		go func() {
 			defer serverWg.Done()
 
-			err := func() error {
-				if server.nodeData.md.isLeaf() {
-					return server.leafDriver()
-				} else {
-					return server.nonLeafDriver()
-				}
-			}()
-			if err != nil {
-				log.Fatalf("failed to run server: %v", err)
-			}
-
-			server.ShutDown()
+			failures.addServer(server, runServer(server))
 		}()
+		return nil
+	}
+
+	liveness = localLiveness(cfg, tree.generator, func(node *NodeData) error {
+		return startNode(node, false)
+	})
+
+	for _, node := range tree.nodes {
+		if done[node.md.id] {
+			continue
+		}
+
+		if err := startNode(node, cfg.crash && node.md.id == cfg.crashId); err != nil {
+			failures.add(err, &NodeError{NodeId: node.md.id, Reason: err.Error()})
+			break
+		}
+	}
+	// watches the drivers until they are all done, along with any standby that takes
+	// over from one
+	watched := func() []*NodeData {
+		serversMutex.Lock()
+		defer serversMutex.Unlock()
+
+		nodes := make([]*NodeData, 0, len(servers))
+		for _, server := range servers {
+			nodes = append(nodes, server.nodeData)
+		}
+		return nodes
 	}
+	stopWatchdog := startWatchdog(watched, cfg.watchdog, cfg.watchdogFile)
 	serverWg.Wait()
+	stopWatchdog()
+
+	// the servers outlive their drivers until every node is done, so a child that
+	// lost the reply to its last message gets it again on a retry
+	shutDownAll(servers)
+
+	if err := failures.first(); err != nil {
+		abandonOutput(outFile, cfg.checkpointDir)
+		return err
+	}
 
 	var maxPhase int32 = 0
-	for _, node := range nodes {
+	for _, node := range tree.nodes {
 		maxPhase = max(maxPhase, node.md.phase)
 	}
 	log.Printf("===> calculation complete in %d rounds", maxPhase)
 
-	return nil
+	logSummary(servers, tree.md.NumEdgesPerNode(), tree.budget)
+	logPartitionStats(cfg.partitionStrategy, tree.partitionStats)
+
+	return finaliseForest(outFile)
+}
+
+func numComponents(edges []*utils.Edge) int {
+	components := make(map[int32]bool)
+	for _, component := range utils.GetComponents(edges) {
+		components[component] = true
+	}
+	return len(components)
 }
 
 func stats(infile, outfile string) {
@@ -164,30 +592,194 @@ func stats(infile, outfile string) {
 		log.Fatalf("[ERROR] failed to read input graph: %v", err)
 	}
 	v, e, w := utils.GetStats(graph)
-	log.Printf("[INFO] graph ->  %d verts, %d edges ,%d weight", v, e, w)
+	graphComponents := numComponents(graph)
+	log.Printf("[INFO] graph ->  %d verts, %d edges ,%d weight, %d components", v, e, w, graphComponents)
 
-	mst, err := utils.ReadGraph(outfile)
+	msf, componentIds, err := utils.ReadForest(outfile)
 	if err != nil {
-		log.Fatalf("[ERROR] failed to read output graph: %v", err)
+		log.Fatalf("[ERROR] failed to read output forest: %v", err)
+	}
+	v, e, w = utils.GetStats(msf)
+
+	componentEdges := make(map[int32][]*utils.Edge)
+	for i, edge := range msf {
+		componentEdges[componentIds[i]] = append(componentEdges[componentIds[i]], edge)
+	}
+	log.Printf("[INFO] msf   ->  %d verts, %d edges ,%d weight, %d components", v, e, w, len(componentEdges))
+
+	ids := make([]int32, 0, len(componentEdges))
+	for id := range componentEdges {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		v, e, w := utils.GetStats(componentEdges[id])
+		log.Printf("[INFO] component %d ->  %d verts, %d edges ,%d weight", id, v, e, w)
+	}
+
+	// a spanning forest has exactly one tree per component of the graph
+	if len(componentEdges) != graphComponents {
+		log.Printf("[WARN] graph has %d components but the forest has %d", graphComponents, len(componentEdges))
 	}
-	v, e, w = utils.GetStats(mst)
-	log.Printf("[INFO] mst   ->  %d verts, %d edges ,%d weight", v, e, w)
 }
 
-func main() {
-	if len(os.Args) != 4 {
-		fmt.Println("usage: go run *.go <infile> <outfile> <alpha>")
+// registers the flags that configure a run, returning a function that builds the
+// config once the flags are parsed
+func addRunFlags(fs *flag.FlagSet) func(alpha float64) (*RunConfig, error) {
+	fanOut := fs.Int("fanout", 0, "children per parent in the aggregation tree (default: derived from S and the budget)")
+	strictWordLimit := fs.Bool("strict", false, "fail when a parent receives more than S words from its children in a phase")
+	budget := fs.Int("budget", 0, "memory budget of a node in words (default: S edges and the fragment ids of their endpoints)")
+	budgetPolicy := fs.String("budget-policy", "fail", "what to do when a node exceeds its budget: report, fail or spill")
+	spillDir := fs.String("spill-dir", os.TempDir(), "directory to spill edges to, with the spill budget policy")
+	partitionStrategy := fs.String("partition", "contiguous", "how to split edges between leaves: contiguous, shuffle, hash or locality")
+	seed := fs.Int64("seed", 42, "seed of the shuffle and locality partitioners")
+	transport := fs.String("transport", "grpc", "how the nodes of a single process talk to each other: grpc, channel or bufconn")
+	stream := fs.Bool("stream", false, "send edges up over a single gRPC stream per child, instead of a call per phase")
+	maxMessageWords := fs.Int("max-message-words", 0, "hard cap on the words of a single message, larger ones are sent in chunks (default: S edges and the fragment ids of their endpoints)")
+	packed := fs.Bool("packed", false, "offer the packed encoding of edges and updates between parents and children")
+	certsDir := fs.String("certs", "", "directory of the certificates written by the certs subcommand, to talk over mutual TLS")
+	retries := fs.Int("retries", 3, "times a child retries a call to its parent that failed on the way")
+	retryBackoff := fs.Duration("retry-backoff", 100*time.Millisecond, "wait before the first retry, doubled for every one after")
+	checkpointDir := fs.String("checkpoint-dir", "", "directory to write the state of every node to at the start of each phase")
+	resume := fs.Bool("resume", false, "resume from the checkpoints in -checkpoint-dir, at the last phase every node started")
+	heartbeat := fs.Duration("heartbeat", 0, "how often children send heartbeats to their parent (default: no heartbeats)")
+	deadAfter := fs.Duration("dead-after", 10*time.Second, "how long a parent waits on a silent child before declaring it dead")
+	deadChild := fs.String("dead-child", "abort", "what a parent does about a dead child: abort, or standby to restore a dead leaf on a standby node")
+	standbys := fs.Int("standbys", 1, "standby nodes of a single process, with the standby dead child policy")
+	crash := fs.String("crash", "", "for testing, crash leaf <id> as phase <phase> starts, given as <id>:<phase>")
+	watchdog := fs.Duration("watchdog", 0, "exit with a dump of every node when no node progresses its phase for this long (default: no watchdog)")
+	watchdogFile := fs.String("watchdog-file", "watchdog.txt", "file the watchdog dumps the state of the nodes to")
+	faultsFile := fs.String("faults", "", "for chaos testing, inject faults into the edges sent up as the policy in this file says")
+
+	return func(alpha float64) (*RunConfig, error) {
+		if *resume && *checkpointDir == "" {
+			return nil, fmt.Errorf("-resume needs the -checkpoint-dir to resume from")
+		}
+
+		policy, err := ParseBudgetPolicy(*budgetPolicy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse budget policy: %v", err)
+		}
+
+		partitioner, err := utils.NewPartitioner(*partitionStrategy, *seed)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse partition strategy: %v", err)
+		}
+
+		deadChildPolicy, err := ParseDeadChildPolicy(*deadChild)
+		if err != nil {
+			return nil, err
+		}
+		if deadChildPolicy == StandbyOnDeadChild && (*checkpointDir == "" || *heartbeat == 0) {
+			return nil, fmt.Errorf("-dead-child standby needs -heartbeat, and the -checkpoint-dir to restore dead leaves from")
+		}
+
+		var faults *FaultPolicy
+		if *faultsFile != "" {
+			if *stream {
+				return nil, fmt.Errorf("faults are only injected into unary calls, not with -stream")
+			}
+			if faults, err = ReadFaultPolicy(*faultsFile); err != nil {
+				return nil, err
+			}
+		}
+
+		var crashId, crashPhase int32
+		if *crash != "" {
+			if _, err := fmt.Sscanf(*crash, "%d:%d", &crashId, &crashPhase); err != nil {
+				return nil, fmt.Errorf("failed to parse -crash %q, expected <id>:<phase>: %v", *crash, err)
+			}
+		}
+
+		return &RunConfig{
+			alpha:           alpha,
+			fanOut:          *fanOut,
+			strictWordLimit: *strictWordLimit,
+			budget:          *budget,
+			budgetPolicy:    policy,
+			spillDir:        *spillDir,
+
+			partitionStrategy: *partitionStrategy,
+			partitioner:       partitioner,
+			transport:         *transport,
+			stream:            *stream,
+			maxMessageWords:   *maxMessageWords,
+			packed:            *packed,
+			certsDir:          *certsDir,
+			retries:           *retries,
+			retryBackoff:      *retryBackoff,
+			checkpointDir:     *checkpointDir,
+			resume:            *resume,
+			heartbeat:         *heartbeat,
+			deadAfter:         *deadAfter,
+			deadChildPolicy:   deadChildPolicy,
+			standbys:          *standbys,
+			crash:             *crash != "",
+			crashId:           crashId,
+			crashPhase:        crashPhase,
+			watchdog:          *watchdog,
+			watchdogFile:      *watchdogFile,
+			faultsFile:        *faultsFile,
+			faults:            faults,
+		}, nil
+	}
+}
+
+// parses <infile> <outfile> <alpha> after the flags
+func parseRunArgs(fs *flag.FlagSet) (string, string, float64) {
+	if fs.NArg() != 3 {
+		fs.Usage()
 		os.Exit(1)
 	}
 
-	infile := os.Args[1]
-	outfile := os.Args[2]
-	alpha, err := strconv.ParseFloat(os.Args[3], 64)
+	alpha, err := strconv.ParseFloat(fs.Arg(2), 64)
 	if err != nil {
 		log.Fatalf("[ERROR] failed to parse alpha: %v", err)
 	}
 
-	err = calcMST(infile, outfile, alpha)
+	return fs.Arg(0), fs.Arg(1), alpha
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "coordinator":
+			coordinatorMain(os.Args[2:])
+			return
+		case "worker":
+			workerMain(os.Args[2:])
+			return
+		case "launch":
+			launchMain(os.Args[2:])
+			return
+		case "certs":
+			certsMain(os.Args[2:])
+			return
+		case "chaos":
+			chaosMain(os.Args[2:])
+			return
+		}
+	}
+
+	buildConfig := addRunFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Println("usage: go run *.go [flags] <infile> <outfile> <alpha>")
+		fmt.Println("       go run *.go coordinator [flags] <infile> <outfile> <alpha>")
+		fmt.Println("       go run *.go worker -manifest <file> -id <node id>")
+		fmt.Println("       go run *.go launch [flags] <infile> <outfile> <alpha>")
+		fmt.Println("       go run *.go certs -dir <dir> (-nodes <n> | -manifest <file>)")
+		fmt.Println("       go run *.go chaos -faults <policy> [flags] <infile> <outfile> <alpha>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	infile, outfile, alpha := parseRunArgs(flag.CommandLine)
+	cfg, err := buildConfig(alpha)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
+	err = calcMST(infile, outfile, cfg)
 	if err != nil {
 		log.Fatalf("[ERROR] failed to run: %v", err)
 	}
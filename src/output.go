@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	utils "mst/sublinear/utils"
+)
+
+// the file the root appends edges to as they are picked. It only becomes the output
+// file once the run succeeds, so a failed run leaves no partial forest behind.
+func partialFile(outFile string) string {
+	return outFile + ".partial"
+}
+
+func startOutput(outFile string) error {
+	if err := os.Remove(outFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove old out file: %v", err)
+	}
+	if err := os.WriteFile(partialFile(outFile), nil, 0644); err != nil {
+		return fmt.Errorf("failed to truncate out file: %v", err)
+	}
+	return nil
+}
+
+func discardOutput(outFile string) {
+	if err := os.Remove(partialFile(outFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("[WARN] failed to remove partial out file: %v", err)
+	}
+}
+
+// the graph may be disconnected, so label the forest with the component of each edge
+func finaliseForest(outFile string) error {
+	forest, err := utils.ReadGraph(partialFile(outFile))
+	if err != nil {
+		return fmt.Errorf("failed to read forest: %v", err)
+	}
+
+	components := utils.GetComponents(forest)
+	if err := utils.WriteForest(outFile, forest, components); err != nil {
+		return fmt.Errorf("failed to write forest: %v", err)
+	}
+
+	discardOutput(outFile)
+	return nil
+}
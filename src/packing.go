@@ -0,0 +1,163 @@
+package main
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"slices"
+
+	comms "mst/sublinear/comms"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// packs a map into parallel arrays, with the keys sorted and delta-encoded so that
+// they mostly fit in a byte or two each
+func packMap(m map[int32]int32) ([]int32, []int32) {
+	keys := make([]int32, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	deltas := make([]int32, len(keys))
+	values := make([]int32, len(keys))
+	prev := int32(0)
+	for i, key := range keys {
+		deltas[i] = key - prev
+		values[i] = m[key]
+		prev = key
+	}
+
+	return deltas, values
+}
+
+func unpackMap(deltas, values []int32) (map[int32]int32, error) {
+	if len(deltas) != len(values) {
+		return nil, fmt.Errorf("packed map has %d keys but %d values", len(deltas), len(values))
+	}
+
+	m := make(map[int32]int32, len(deltas))
+	key := int32(0)
+	for i, delta := range deltas {
+		key += delta
+		m[key] = values[i]
+	}
+
+	return m, nil
+}
+
+// packs edges sorted by their endpoints, each as the varint delta of u from the
+// previous edge, followed by v relative to u and the weight as signed varints.
+// Edges keep their orientation, only their order is lost.
+func packEdges(edges []*comms.EdgeData) []byte {
+	sorted := slices.Clone(edges)
+	slices.SortFunc(sorted, func(a, b *comms.EdgeData) int {
+		return cmp.Or(cmp.Compare(a.GetU(), b.GetU()), cmp.Compare(a.GetV(), b.GetV()), cmp.Compare(a.GetWeight(), b.GetWeight()))
+	})
+
+	buf := make([]byte, 0, 4*len(sorted))
+	prevU := int64(0)
+	for _, edge := range sorted {
+		u := int64(edge.GetU())
+		buf = binary.AppendUvarint(buf, uint64(u-prevU))
+		buf = binary.AppendVarint(buf, int64(edge.GetV())-u)
+		buf = binary.AppendVarint(buf, int64(edge.GetWeight()))
+		prevU = u
+	}
+
+	return buf
+}
+
+func unpackEdges(buf []byte) ([]*comms.EdgeData, error) {
+	edges := []*comms.EdgeData{}
+	u := int64(0)
+	for len(buf) > 0 {
+		delta, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, fmt.Errorf("corrupt packed edge %d", len(edges))
+		}
+		buf = buf[n:]
+		v, n := binary.Varint(buf)
+		if n <= 0 {
+			return nil, fmt.Errorf("corrupt packed edge %d", len(edges))
+		}
+		buf = buf[n:]
+		weight, n := binary.Varint(buf)
+		if n <= 0 {
+			return nil, fmt.Errorf("corrupt packed edge %d", len(edges))
+		}
+		buf = buf[n:]
+
+		u += int64(delta)
+		edges = append(edges, &comms.EdgeData{U: int32(u), V: int32(u + v), Weight: int32(weight)})
+	}
+
+	return edges, nil
+}
+
+// a copy of the message in the packed encoding
+func packEdgesMessage(data *comms.Edges) *comms.Edges {
+	packed := proto.Clone(data).(*comms.Edges)
+	packed.Encoding = comms.Encoding_PACKED
+	packed.PackedEdges = packEdges(data.GetEdges())
+	packed.PackedVertices, packed.PackedFragmentIds = packMap(data.GetFragmentIds())
+	packed.Edges = nil
+	packed.FragmentIds = nil
+
+	return packed
+}
+
+// a copy of the message in the plain encoding, as is if it is plain already
+func unpackEdgesMessage(data *comms.Edges) (*comms.Edges, error) {
+	if data.GetEncoding() != comms.Encoding_PACKED {
+		return data, nil
+	}
+
+	edges, err := unpackEdges(data.GetPackedEdges())
+	if err != nil {
+		return nil, err
+	}
+	fragmentIds, err := unpackMap(data.GetPackedVertices(), data.GetPackedFragmentIds())
+	if err != nil {
+		return nil, err
+	}
+
+	plain := proto.Clone(data).(*comms.Edges)
+	plain.Encoding = comms.Encoding_PLAIN
+	plain.Edges = edges
+	plain.FragmentIds = fragmentIds
+	plain.PackedEdges = nil
+	plain.PackedVertices = nil
+	plain.PackedFragmentIds = nil
+
+	return plain, nil
+}
+
+func packUpdateMessage(update *comms.Update) *comms.Update {
+	packed := proto.Clone(update).(*comms.Update)
+	packed.Encoding = comms.Encoding_PACKED
+	packed.PackedFragments, packed.PackedUpdates = packMap(update.GetUpdates())
+	packed.Updates = nil
+
+	return packed
+}
+
+func unpackUpdateMessage(update *comms.Update) (*comms.Update, error) {
+	if update.GetEncoding() != comms.Encoding_PACKED {
+		return update, nil
+	}
+
+	updates, err := unpackMap(update.GetPackedFragments(), update.GetPackedUpdates())
+	if err != nil {
+		return nil, err
+	}
+
+	plain := proto.Clone(update).(*comms.Update)
+	plain.Encoding = comms.Encoding_PLAIN
+	plain.Updates = updates
+	plain.PackedFragments = nil
+	plain.PackedUpdates = nil
+
+	return plain, nil
+}
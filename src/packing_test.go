@@ -0,0 +1,122 @@
+package main
+
+import (
+	"cmp"
+	"maps"
+	"math"
+	"slices"
+	"testing"
+
+	comms "mst/sublinear/comms"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// the edges in the order packing puts them in
+func sortedEdges(edges []*comms.EdgeData) []*comms.EdgeData {
+	sorted := slices.Clone(edges)
+	slices.SortFunc(sorted, func(a, b *comms.EdgeData) int {
+		return cmp.Or(cmp.Compare(a.GetU(), b.GetU()), cmp.Compare(a.GetV(), b.GetV()), cmp.Compare(a.GetWeight(), b.GetWeight()))
+	})
+	return sorted
+}
+
+func TestPackEdgesRoundTrip(t *testing.T) {
+	cases := map[string][]*comms.EdgeData{
+		"empty":            {},
+		"single":           {{U: 1, V: 2, Weight: 3}},
+		"negative weights": {{U: 1, V: 2, Weight: -3}, {U: 4, V: 5, Weight: -1000000}, {U: 0, V: 9, Weight: 0}},
+		"u over v":         {{U: 9, V: 2, Weight: 3}, {U: 100000, V: 1, Weight: 7}, {U: 5, V: 4, Weight: -2}},
+		"repeated":         {{U: 3, V: 4, Weight: 1}, {U: 3, V: 4, Weight: 1}, {U: 4, V: 3, Weight: 1}},
+		"extremes": {
+			{U: math.MaxInt32, V: 0, Weight: math.MinInt32},
+			{U: 0, V: math.MaxInt32, Weight: math.MaxInt32},
+			{U: -5, V: math.MinInt32, Weight: -1},
+		},
+		"unsorted": randomEdgesMessage(200, 4).GetEdges(),
+	}
+	for name, edges := range cases {
+		got, err := unpackEdges(packEdges(edges))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		// only the order is lost
+		expected := sortedEdges(edges)
+		if len(got) != len(expected) {
+			t.Fatalf("%s: got %d edges back, expected %d", name, len(got), len(expected))
+		}
+		for i := range got {
+			if !proto.Equal(got[i], expected[i]) {
+				t.Fatalf("%s: got edge %v back, expected %v", name, got[i], expected[i])
+			}
+		}
+	}
+
+	if len(packEdges(nil)) != 0 {
+		t.Fatal("expected no edges to pack to no bytes")
+	}
+	if _, err := unpackEdges([]byte{0x80}); err == nil {
+		t.Fatal("expected a truncated edge to fail")
+	}
+}
+
+func TestPackMapRoundTrip(t *testing.T) {
+	cases := map[string]map[int32]int32{
+		"empty":     {},
+		"single":    {7: 7},
+		"negative":  {-4: 2, 3: -9, 0: 0},
+		"extremes":  {math.MinInt32: math.MaxInt32, math.MaxInt32: math.MinInt32, 0: 1},
+		"fragments": randomEdgesMessage(100, 5).GetFragmentIds(),
+	}
+	for name, m := range cases {
+		deltas, values := packMap(m)
+		got, err := unpackMap(deltas, values)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !maps.Equal(got, m) {
+			t.Fatalf("%s: got %v back, expected %v", name, got, m)
+		}
+	}
+
+	if _, err := unpackMap([]int32{1, 2}, []int32{1}); err == nil {
+		t.Fatal("expected keys without values to fail")
+	}
+}
+
+func TestPackMessagesRoundTrip(t *testing.T) {
+	for _, msg := range []*comms.Edges{
+		randomEdgesMessage(50, 6),
+		{SrcId: 3, Phase: 1, JobId: "job", NoMoreUpdates: true},
+	} {
+		packed := packEdgesMessage(msg)
+		if packed.GetEncoding() != comms.Encoding_PACKED || len(packed.GetEdges()) != 0 || len(packed.GetFragmentIds()) != 0 {
+			t.Fatalf("got %v, expected only the packed fields", packed)
+		}
+
+		plain, err := unpackEdgesMessage(packed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := proto.Clone(msg).(*comms.Edges)
+		expected.Edges = sortedEdges(expected.GetEdges())
+		if !proto.Equal(plain, expected) {
+			t.Fatalf("got %v back, expected %v", plain, expected)
+		}
+
+		// a plain message is read as it is
+		if again, err := unpackEdgesMessage(plain); err != nil || again != plain {
+			t.Fatalf("got %v and %v, expected the plain message as it is", again, err)
+		}
+	}
+
+	update := &comms.Update{Phase: 4, JobId: "job", Chunk: 1, NumChunks: 3, Updates: map[int32]int32{5: 1, 9: 1, -2: 8}}
+	plain, err := unpackUpdateMessage(packUpdateMessage(update))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(plain, update) {
+		t.Fatalf("got %v back, expected %v", plain, update)
+	}
+}
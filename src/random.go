@@ -23,6 +23,20 @@ func NewSharedRandomness() *SharedRandomness {
 	}
 }
 
+/*
+* NOTE: fnv-1a diffuses its input poorly (the lowest bit is just the parity of
+* the input bytes), so the colour of a fragment barely changed across rounds.
+* The murmur3 finaliser spreads every input bit over the whole hash.
+ */
+func mix(h uint32) uint32 {
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
 /*
 * NOTE: this is just a simulation of shared randomness, through
 * a common hash containing some global seed.
@@ -32,10 +46,17 @@ func (sr *SharedRandomness) GetFragmentColour(round, id int) FragColour {
 
 	hasher := fnv.New32a()
 	_, _ = hasher.Write([]byte(inputStr))
-	hashValue := hasher.Sum32()
+	hashValue := mix(hasher.Sum32())
 
 	if hashValue%2 == 0 {
 		return BlueFrag
 	}
 	return RedFrag
 }
+
+// a fragment may only hook onto another (through its moe) if it is blue and the
+// other is red. Every merge in a round thus forms a star around a red fragment.
+func (sr *SharedRandomness) CanHook(round int, srcFrag, trgFrag int32) bool {
+	return sr.GetFragmentColour(round, int(srcFrag)) == BlueFrag &&
+		sr.GetFragmentColour(round, int(trgFrag)) == RedFrag
+}
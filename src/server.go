@@ -2,38 +2,144 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	"math"
 	comms "mst/sublinear/comms"
 	utils "mst/sublinear/utils"
-	"slices"
+	"os"
+	"sync"
+	"time"
 
-	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// how long a failing node tries to tell its parent
+const failureReportTimeout = 5 * time.Second
+
 type SubLinearServer struct {
 	receivedCount int // during upward propogation, number of children we received edges from
 	nodeData      *NodeData
 	outFile       string
 
-	grpcServer *grpc.Server
+	// words received from children in the current phase, checked against the limit S
+	wordsMutex          sync.Mutex
+	receivedWords       int
+	wordLimit           int32
+	strictWordLimit     bool
+	wordLimitViolations int
+	totalReceivedWords  int
+	// hard cap on the words in a single message, either way
+	maxMessageWords int
+
+	// whether we read and write the packed encoding, and whether the parent agreed to
+	// it. Bytes sent and received by the child, as they went over the wire and as they
+	// would have in the plain encoding.
+	packed       bool
+	parentPacked bool
+	wireBytes    int
+	plainBytes   int
+
+	// the run this node belongs to, checked on every message
+	jobId string
+	// retries of calls to the parent
+	retries      int
+	retryBackoff time.Duration
+	// whether edges go up over a stream, on which calls wait with no deadline
+	stream bool
+	// where to write the state of the node at the start of every phase, if set
+	checkpointDir string
+	// heartbeats to the parent and supervision of the children
+	liveness LivenessConfig
+	// for testing, crash as the given phase starts
+	crash      bool
+	crashPhase int32
+
+	// cancelled when the node has to give up, with the reason as its cause
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	// the messages of children delivered in this phase and the last, checked against
+	// and pruned along with the published phase
+	deliveredMutex sync.Mutex
+	delivered      map[deliveryKey]bool
+
+	transport Transport
 	comms.UnimplementedEdgeDataServiceServer
 }
 
-func NewSubLinearServer(nodeData *NodeData, outFile string) (*SubLinearServer, error) {
+// options of a single server
+type ServerConfig struct {
+	// where the root appends the edges of the msf
+	outFile string
+	// the words a parent may receive from its children in a phase (S), and whether
+	// going over it fails the run
+	wordLimit       int32
+	strictWordLimit bool
+	// hard cap on the words in a single message
+	maxMessageWords int
+	// offer the packed encoding to the parent, and accept it from children
+	packed bool
+	jobId  string
+	// how often to retry a call to the parent that failed on the way, and how long to
+	// wait before the first retry
+	retries      int
+	retryBackoff time.Duration
+	// edges go up over a single stream for the whole run
+	stream bool
+	// directory to write a checkpoint of the node to at every phase, if set
+	checkpointDir string
+	liveness      LivenessConfig
+	// for testing, a leaf may be made to crash as a phase starts
+	crash      bool
+	crashPhase int32
+}
+
+// a message from a child, as far as telling a repeat of it goes
+type deliveryKey struct {
+	srcId int32
+	phase int32
+	chunk int32
+}
+
+// the server gives up when ctx is cancelled, which is how the nodes of a process are
+// all taken down by the failure of one
+func NewSubLinearServer(ctx context.Context, nodeData *NodeData, cfg ServerConfig, transport Transport) (*SubLinearServer, error) {
 	s := &SubLinearServer{
-		receivedCount: 0,
-		nodeData:      nodeData,
-		outFile:       outFile,
-		grpcServer:    grpc.NewServer(grpc.MaxSendMsgSize(math.MaxInt64), grpc.MaxRecvMsgSize(math.MaxInt64)),
+		receivedCount:   0,
+		nodeData:        nodeData,
+		outFile:         cfg.outFile,
+		wordLimit:       cfg.wordLimit,
+		strictWordLimit: cfg.strictWordLimit,
+		maxMessageWords: cfg.maxMessageWords,
+		packed:          cfg.packed,
+		jobId:           cfg.jobId,
+		retries:         cfg.retries,
+		retryBackoff:    cfg.retryBackoff,
+		stream:          cfg.stream,
+		checkpointDir:   cfg.checkpointDir,
+		liveness:        cfg.liveness,
+		crash:           cfg.crash,
+		crashPhase:      cfg.crashPhase,
+		delivered:       make(map[deliveryKey]bool),
+		transport:       transport,
 	}
+	s.ctx, s.cancel = context.WithCancelCause(ctx)
 
-	comms.RegisterEdgeDataServiceServer(s.grpcServer, s)
+	// the children of a parent may change as soon as it serves, so its state is
+	// saved beforehand (leaves save theirs as they start a phase)
+	if s.nodeData.md.hasChildren() {
+		if err := s.checkpoint(s.nodeData.md.phase, false); err != nil {
+			return nil, err
+		}
+	}
+
+	// the children may send edges as soon as we serve, so expect them beforehand
+	s.nodeData.barrier.Expect(s.nodeData.md.phase, len(s.nodeData.md.children))
 	go func() {
-		// TODO: consider removing the Fatalf and returning an error instead (would involve channels and such)
-		if err := s.grpcServer.Serve(s.nodeData.md.lis); err != nil {
-			log.Fatalf("%s - failed to serve: %v", s.nodeData.md.GetAddr(), err)
+		if err := s.transport.Serve(s); err != nil {
+			s.cancel(fmt.Errorf("failed to serve: %v", err))
 		}
 	}()
 	log.Printf("%s - server started", s.nodeData.md.GetAddr())
@@ -41,12 +147,97 @@ func NewSubLinearServer(nodeData *NodeData, outFile string) (*SubLinearServer, e
 	return s, nil
 }
 
+// waits for the edges of every child, or for the node to give up
+func (s *SubLinearServer) waitForChildren() error {
+	return s.nodeData.barrier.WaitArrived(s.ctx, s.nodeData.md.phase)
+}
+
+// turns the error the node gave up with into a failure of the run. It is reported
+// up the tree, unless it came from there, and passed on to the children.
+func (s *SubLinearServer) fail(err error) error {
+	if s.ctx.Err() != nil {
+		// whatever the driver ran into, it was because the node was cancelled
+		err = context.Cause(s.ctx)
+	}
+
+	var aborted *abortedError
+	var nodeErr *NodeError
+	switch {
+	case errors.As(err, &aborted):
+		nodeErr = aborted.cause
+	case errors.As(err, &nodeErr):
+		// the failure of a descendant, passing through
+		s.reportFailure(nodeErr)
+		err = nodeErr
+	default:
+		nodeErr = &NodeError{NodeId: s.nodeData.md.id, Phase: s.nodeData.md.phase, Reason: err.Error()}
+		log.Printf("[ERROR] %v", nodeErr)
+		s.reportFailure(nodeErr)
+		err = nodeErr
+	}
+
+	s.abortChildren(nodeErr)
+	return err
+}
+
+func (s *SubLinearServer) reportFailure(nodeErr *NodeError) {
+	if s.nodeData.md.parent == nil {
+		return
+	}
+
+	// the context of the node may be gone already, the report goes out regardless
+	ctx, cancel := context.WithTimeout(context.Background(), failureReportTimeout)
+	defer cancel()
+
+	req := &comms.Edges{SrcId: s.nodeData.md.id, Phase: s.nodeData.md.phase, JobId: s.jobId, Failure: nodeErr.toProto()}
+	if _, err := s.transport.SendUp(ctx, s.nodeData.md.parent, req); err != nil {
+		log.Printf("[WARN] %d - failed to report the failure to parent %d: %v", s.nodeData.md.id, s.nodeData.md.parent.id, err)
+	}
+}
+
+// wakes the handlers of the children with the failure, and answers any that come
+// later with it too
+func (s *SubLinearServer) abortChildren(nodeErr *NodeError) {
+	s.nodeData.barrier.Abort(nodeErr)
+}
+
+// the update that aborts a child, or nil if the node has not given up
+func (s *SubLinearServer) abortUpdate(phase int32) *comms.Update {
+	failure := s.nodeData.barrier.Failure()
+	if failure == nil {
+		return nil
+	}
+	return &comms.Update{Phase: phase, JobId: s.jobId, Failure: failure.toProto()}
+}
+
+// writes the state of the node at the start of a phase, if checkpoints are on. The
+// root also notes how much of the forest it wrote by then.
+func (s *SubLinearServer) checkpoint(phase int32, done bool) error {
+	if s.checkpointDir == "" {
+		return nil
+	}
+
+	cp, err := newCheckpoint(s.nodeData, phase, done)
+	if err != nil {
+		return fmt.Errorf("failed to take checkpoint: %v", err)
+	}
+	if s.nodeData.md.isRoot() {
+		info, err := os.Stat(s.outFile)
+		if err != nil {
+			return fmt.Errorf("failed to take checkpoint: %v", err)
+		}
+		cp.OutFileBytes = info.Size()
+	}
+
+	return writeCheckpoint(s.checkpointDir, cp)
+}
+
 func (s *SubLinearServer) ShutDown() {
-	s.grpcServer.GracefulStop()
+	s.transport.Stop()
 	log.Printf("%s - server stopped", s.nodeData.md.GetAddr())
 }
 
-func (s *SubLinearServer) updateState(edgeData []*comms.EdgeData, fragmentIds map[int32]int32) {
+func (s *SubLinearServer) updateState(edgeData []*comms.EdgeData, fragmentIds map[int32]int32) error {
 	// add edges from request
 	edges := []*utils.Edge{}
 	for _, edgeData := range edgeData {
@@ -57,44 +248,92 @@ func (s *SubLinearServer) updateState(edgeData []*comms.EdgeData, fragmentIds ma
 		edge := utils.NewEdge(src, dest, weight)
 		edges = append(edges, edge)
 	}
-	s.nodeData.AddEdges(edges)
+	if err := s.nodeData.AddEdges(edges); err != nil {
+		return err
+	}
 
 	// mark the fragments the nodes belong to
-	for node, fragment := range fragmentIds {
-		s.nodeData.UpdateFragment(node, fragment)
+	return s.nodeData.UpdateFragments(fragmentIds)
+}
+
+// the number of words in a message from a child
+func numWords(data *comms.Edges) int {
+	return wordsPerEdge*len(data.GetEdges()) + wordsPerFragment*len(data.GetFragmentIds())
+}
+
+func (s *SubLinearServer) addReceivedWords(words int) {
+	s.wordsMutex.Lock()
+	defer s.wordsMutex.Unlock()
+
+	s.receivedWords += words
+}
+
+func (s *SubLinearServer) addWireBytes(wire, plain int) {
+	s.wordsMutex.Lock()
+	defer s.wordsMutex.Unlock()
+
+	s.wireBytes += wire
+	s.plainBytes += plain
+}
+
+// checks the words received from children in this phase against the limit, and resets the count
+func (s *SubLinearServer) checkReceivedWords() error {
+	s.wordsMutex.Lock()
+	defer s.wordsMutex.Unlock()
+
+	words := s.receivedWords
+	s.receivedWords = 0
+	s.totalReceivedWords += words
+	if words <= int(s.wordLimit) {
+		return nil
 	}
+
+	s.wordLimitViolations++
+	if s.strictWordLimit {
+		return fmt.Errorf("%d - received %d words from children in phase %d, limit is %d", s.nodeData.md.id, words, s.nodeData.md.phase, s.wordLimit)
+	}
+	log.Printf("[WARN] %d - received %d words from children in phase %d, limit is %d", s.nodeData.md.id, words, s.nodeData.md.phase, s.wordLimit)
+
+	return nil
 }
 
 func (s *SubLinearServer) getMoeUpdate() (*comms.Update, error) {
-	adjacencyList := utils.CreateAdjacencyList(s.nodeData.edges)
+	edges, err := s.nodeData.GetEdges()
+	if err != nil {
+		return nil, err
+	}
+	adjacencyList := utils.CreateAdjacencyList(edges)
 	moes := utils.GetMoEs(adjacencyList, s.nodeData.fragments)
 	log.Printf("-----> %v are moes", moes)
 
-	updatesMap := make(map[int32]int32)
+	// merge in the canonical edge order, so the result does not depend on map order
+	utils.SortEdges(moes)
+
+	merges := utils.NewDisjointSet()
 
+	sr := NewSharedRandomness()
+	round := int(s.nodeData.md.phase)
 	for _, edge := range moes {
 		srcFragment := int32(s.nodeData.fragments[edge.U])
 		trgFragment := int32(s.nodeData.fragments[edge.V])
 
-		// until the introduction of red-blue randomness
-		newFrags := func() bool {
-			for src, trg := range updatesMap {
-				nodes := []int32{srcFragment, trgFragment}
-				if slices.Contains(nodes, src) || slices.Contains(nodes, trg) {
-					return false
-				}
-			}
-			return true
-		}()
-		if !newFrags {
+		// red fragments never hook, so every merge of a round forms a star
+		if !sr.CanHook(round, srcFragment, trgFragment) {
+			continue
+		}
+
+		// an moe that would close a cycle among the merges of this round is skipped
+		if !merges.Union(srcFragment, trgFragment) {
 			continue
 		}
 
-		updatesMap[srcFragment] = trgFragment
-		utils.WriteGraph(s.outFile, []*utils.Edge{edge})
+		if err := utils.WriteGraph(s.outFile, []*utils.Edge{edge}); err != nil {
+			return nil, fmt.Errorf("failed to write mst edge: %v", err)
+		}
 	}
 
-	update := &comms.Update{Updates: updatesMap}
+	// every fragment is mapped directly onto its final representative
+	update := &comms.Update{Updates: merges.Flatten()}
 
 	return update, nil
 }
@@ -103,62 +342,351 @@ func (s *SubLinearServer) nonLeafDriver() error {
 	// while we have children
 	for len(s.nodeData.md.children) > 0 {
 		// wait for the moes from all the children
-		s.nodeData.childReqWg.Add(len(s.nodeData.md.children))
-		s.nodeData.childReqWg.Wait()
+		if err := s.waitForChildren(); err != nil {
+			return err
+		}
 
 		log.Printf("STATE AFTER GETTING CHILD UPDATE: %s", s.nodeData.String())
 
+		if err := s.checkReceivedWords(); err != nil {
+			return err
+		}
+
 		// upward prop
 		update, error := func() (*comms.Update, error) {
 			if s.nodeData.md.parent != nil {
-				noMoreUpdates, edges, fragments := s.getEdgesToSend()
+				noMoreUpdates, edges, fragments, err := s.getEdgesToSend()
+				if err != nil {
+					return nil, err
+				}
 				return s.sendEdgesUp(noMoreUpdates, edges, fragments)
 			} else {
 				return s.getMoeUpdate()
 			}
 		}()
 		if error != nil {
-			return fmt.Errorf("failed to send edges up: %v", error)
+			return fmt.Errorf("failed to send edges up: %w", error)
 		}
 
 		// delete current store of edges and fragments
-		s.nodeData.ClearEdges()
+		if err := s.nodeData.ClearEdges(); err != nil {
+			return fmt.Errorf("failed to clear edges: %v", err)
+		}
 		s.nodeData.ClearFragments()
 
-		// set the update and wake the consumers (handlers of RPC calls from children)
-		s.nodeData.setUpdate(update.GetUpdates())
-		s.nodeData.updateCond.Broadcast()
+		// the children are only sure to be as the next phase starts with until the
+		// update is out
+		if err := s.checkpoint(s.nodeData.md.phase+1, false); err != nil {
+			return err
+		}
+
+		// expect the children of the next phase before any of them is woken up, as
+		// they send their next edges straight away
+		s.nodeData.barrier.Expect(s.nodeData.md.phase+1, len(s.nodeData.md.children))
+
+		// publish the update and wake the handlers of the children waiting on it
+		s.deliveredMutex.Lock()
+		s.nodeData.setUpdate(s.nodeData.md.phase, update.GetUpdates())
+		for key := range s.delivered {
+			// repeats of this phase may still come, the older ones are rejected
+			if key.phase < s.nodeData.md.phase {
+				delete(s.delivered, key)
+			}
+		}
+		s.deliveredMutex.Unlock()
 
 		// progress the phase counter
 		s.nodeData.md.progressPhase()
 	}
 
-	return nil
+	return s.checkpoint(s.nodeData.md.phase, true)
 }
 
 // --- RPC ---
 
 func (s *SubLinearServer) PropogateUp(ctx context.Context, data *comms.Edges) (*comms.Update, error) {
-	// update state with received data
-	s.updateState(data.GetEdges(), data.GetFragmentIds())
+	reply, err := s.takeEdges(data)
+	if reply != nil || err != nil {
+		return reply, err
+	}
+	return s.awaitUpdate(ctx, data)
+}
 
-	// if th child no longer has moes, remove from further consideration (in further rounds)
-	if data.GetNoMoreUpdates() {
-		s.nodeData.md.RemoveChild(data.GetSrcId())
+// takes in a message of a child, and answers it, unless the child is to wait for the
+// update of the phase (a nil answer and error)
+func (s *SubLinearServer) takeEdges(data *comms.Edges) (*comms.Update, error) {
+	if err := s.checkJob(data.GetSrcId(), data.GetJobId()); err != nil {
+		return nil, err
+	}
+	s.nodeData.md.markAlive(data.GetSrcId())
+	if failure := data.GetFailure(); failure != nil {
+		return s.childFailed(data.GetSrcId(), nodeErrorFromProto(failure)), nil
+	}
+	if update := s.abortUpdate(data.GetPhase()); update != nil {
+		return update, nil
 	}
 
-	// received an update from a child
-	log.Printf("%d - received edges from child", s.nodeData.md.id)
-	s.nodeData.childReqWg.Done()
+	// the node, not the child, fails if it cannot take the edges in
+	var stateErr error
+	first, err := s.deliver(data, func() error {
+		plain, err := unpackEdgesMessage(data)
+		if err != nil {
+			return fmt.Errorf("%d - child %d sent %v", s.nodeData.md.id, data.GetSrcId(), err)
+		}
 
-	// wait until update is set (consumer of Cond)
-	s.nodeData.updateCond.L.Lock()
-	s.nodeData.updateCond.Wait()
-	s.nodeData.updateCond.L.Unlock()
+		words := numWords(plain)
+		if words > s.maxMessageWords {
+			err := &MessageTooLargeError{Words: words, MaxWords: s.maxMessageWords}
+			return fmt.Errorf("%d - child %d sent a %v", s.nodeData.md.id, data.GetSrcId(), err)
+		}
 
-	// propogate update down
-	log.Printf("%d - received update %v", s.nodeData.md.id, s.nodeData.update)
-	resp := &comms.Update{Updates: s.nodeData.update}
+		// update state with received data
+		s.addReceivedWords(words)
+		stateErr = s.updateState(plain.GetEdges(), plain.GetFragmentIds())
+		return stateErr
+	})
+	if stateErr != nil {
+		return s.receiveFailed(data.GetPhase(), fmt.Errorf("failed to update state: %v", stateErr)), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !first {
+		// the child retried, and its edges are in the state already
+		log.Printf("[WARN] %d - child %d redelivered chunk %d of phase %d", s.nodeData.md.id, data.GetSrcId(), data.GetChunk(), data.GetPhase())
+	}
+
+	// the chunks of a message are added to the state as they come, and only the last
+	// one waits for the update
+	if data.GetChunk() < data.GetNumChunks()-1 {
+		return s.encodeUpdate(&comms.Update{Phase: data.GetPhase()}, data.GetAcceptsPacked()), nil
+	}
+
+	if first {
+		// if th child no longer has moes, remove from further consideration (in further rounds)
+		if data.GetNoMoreUpdates() {
+			s.nodeData.md.RemoveChild(data.GetSrcId())
+		}
+
+		// received an update from a child. A repeated message does not count towards
+		// the phase again, and may come after the update is out.
+		log.Printf("%d - received edges from child", s.nodeData.md.id)
+		s.nodeData.barrier.Arrive(data.GetPhase(), data.GetSrcId())
+	}
+	return nil, nil
+}
+
+// waits until the update of the phase of a message is out, and answers with its first
+// chunk
+func (s *SubLinearServer) awaitUpdate(ctx context.Context, data *comms.Edges) (*comms.Update, error) {
+	phase, update, err := s.nodeData.barrier.WaitPublished(ctx, data.GetPhase())
+	var failure *NodeError
+	if errors.As(err, &failure) {
+		return &comms.Update{Phase: data.GetPhase(), JobId: s.jobId, Failure: failure.toProto()}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if phase != data.GetPhase() {
+		return nil, status.Errorf(codes.FailedPrecondition, "%d - child %d waited for the update of phase %d, in phase %d",
+			s.nodeData.md.id, data.GetSrcId(), data.GetPhase(), phase)
+	}
+
+	// propogate update down, the rest of its chunks are fetched by the child
+	log.Printf("%d - received update %v", s.nodeData.md.id, update)
+	chunk, err := chunkUpdate(update, data.GetPhase(), 0, s.maxMessageWords)
+	if err != nil {
+		return nil, err
+	}
+	return s.encodeUpdate(chunk, data.GetAcceptsPacked()), nil
+}
+
+// a child gave up, so the phase will never complete. The driver stops waiting for
+// the other children, and takes the failure up the tree.
+func (s *SubLinearServer) childFailed(childId int32, nodeErr *NodeError) *comms.Update {
+	log.Printf("[ERROR] %d - child %d reported: %v", s.nodeData.md.id, childId, nodeErr)
+	s.cancel(nodeErr)
+
+	return &comms.Update{Phase: nodeErr.Phase, JobId: s.jobId}
+}
+
+// the node could not take in the edges of a child, over its budget say. It gives up
+// as the node that failed, and answers the child with the failure, as it would any
+// child waiting on the update.
+func (s *SubLinearServer) receiveFailed(phase int32, err error) *comms.Update {
+	nodeErr := &NodeError{NodeId: s.nodeData.md.id, Phase: phase, Reason: err.Error()}
+	log.Printf("[ERROR] %v", nodeErr)
+	s.cancel(nodeErr)
+
+	return &comms.Update{Phase: phase, JobId: s.jobId, Failure: nodeErr.toProto()}
+}
+
+// takes in a message of a child with apply, unless it was delivered already, and says
+// whether this is the first delivery. Edges are only taken for the phase being
+// collected, but a repeat of them may come later, until the next phase is collected.
+// A message only counts as delivered once apply took it in, so one that failed is
+// taken in again if the child retries it.
+func (s *SubLinearServer) deliver(data *comms.Edges, apply func() error) (bool, error) {
+	s.deliveredMutex.Lock()
+	defer s.deliveredMutex.Unlock()
+
+	key := deliveryKey{srcId: data.GetSrcId(), phase: data.GetPhase(), chunk: data.GetChunk()}
+	if s.delivered[key] {
+		return false, nil
+	}
+
+	// edges of the phase we are collecting, and not some late message
+	if phase, _ := s.nodeData.getUpdate(); data.GetPhase() != phase+1 {
+		return false, status.Errorf(codes.FailedPrecondition, "%d - child %d sent edges of phase %d, in phase %d",
+			s.nodeData.md.id, data.GetSrcId(), data.GetPhase(), phase+1)
+	}
+
+	if err := apply(); err != nil {
+		return false, err
+	}
+	s.delivered[key] = true
+	return true, nil
+}
+
+func (s *SubLinearServer) checkJob(childId int32, jobId string) error {
+	if jobId != s.jobId {
+		return status.Errorf(codes.InvalidArgument, "%d - child %d sent a message of job %q, in job %q",
+			s.nodeData.md.id, childId, jobId, s.jobId)
+	}
+	return nil
+}
+
+func (s *SubLinearServer) FetchUpdate(ctx context.Context, req *comms.UpdateRequest) (*comms.Update, error) {
+	if err := s.checkJob(req.GetSrcId(), req.GetJobId()); err != nil {
+		return nil, err
+	}
+	if update := s.abortUpdate(req.GetPhase()); update != nil {
+		return update, nil
+	}
 
-	return resp, nil
+	update, ok := s.nodeData.barrier.Update(req.GetPhase())
+	if !ok {
+		phase, _ := s.nodeData.getUpdate()
+		return nil, status.Errorf(codes.FailedPrecondition, "%d - child %d asked for the update of phase %d, in phase %d",
+			s.nodeData.md.id, req.GetSrcId(), req.GetPhase(), phase)
+	}
+
+	chunk, err := chunkUpdate(update, req.GetPhase(), req.GetChunk(), s.maxMessageWords)
+	if err != nil {
+		return nil, err
+	}
+	return s.encodeUpdate(chunk, req.GetAcceptsPacked()), nil
+}
+
+func (s *SubLinearServer) Heartbeat(ctx context.Context, req *comms.HeartbeatRequest) (*comms.HeartbeatReply, error) {
+	if err := s.checkJob(req.GetSrcId(), req.GetJobId()); err != nil {
+		return nil, err
+	}
+	s.nodeData.md.markAlive(req.GetSrcId())
+
+	phase, _ := s.nodeData.getUpdate()
+	return &comms.HeartbeatReply{Phase: phase + 1}, nil
+}
+
+// packs the update for children that read the packed encoding, if we write it too.
+// A packed update is also how the child learns that we read packed edges.
+func (s *SubLinearServer) encodeUpdate(update *comms.Update, acceptsPacked bool) *comms.Update {
+	update.JobId = s.jobId
+	if !s.packed || !acceptsPacked {
+		return update
+	}
+	return packUpdateMessage(update)
+}
+
+// how many messages of a child on a stream may wait for their answers. A child waits
+// for the answer to each of its messages, so there is hardly ever more than one.
+const maxPendingAnswers = 8
+
+// the answers to a message on a stream, sent back in the order the messages came in
+type streamAnswer struct {
+	updates []*comms.Update
+	err     error
+}
+
+// the edges of every phase of a child over a single stream, which lives for the whole
+// run. Each message is taken in as it comes and answered as by PropogateUp, with the
+// rest of the chunks of an update pushed right after it. Waiting for the update does
+// not hold up the stream, and there is no deadline on it: a dead child is found by
+// its heartbeats, and one that goes away ends the stream.
+func (s *SubLinearServer) PropogateStream(stream comms.EdgeDataService_PropogateStreamServer) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	answers := make(chan chan streamAnswer, maxPendingAnswers)
+	recvErr := make(chan error, 1)
+	go func() {
+		defer close(answers)
+		for {
+			data, err := stream.Recv()
+			if err != nil {
+				if err != io.EOF {
+					recvErr <- err
+				}
+				return
+			}
+
+			answer := make(chan streamAnswer, 1)
+			select {
+			case answers <- answer:
+			case <-ctx.Done():
+				return
+			}
+
+			// the edges go into the state in the order they were sent, only the wait
+			// for the update goes on the side
+			reply, err := s.takeEdges(data)
+			if reply != nil || err != nil {
+				answer <- streamAnswer{updates: []*comms.Update{reply}, err: err}
+				continue
+			}
+			go func() {
+				updates, err := s.streamUpdate(ctx, data)
+				answer <- streamAnswer{updates: updates, err: err}
+			}()
+		}
+	}()
+
+	for answer := range answers {
+		reply := <-answer
+		if reply.err != nil {
+			return reply.err
+		}
+		for _, update := range reply.updates {
+			if err := stream.Send(update); err != nil {
+				return err
+			}
+		}
+	}
+
+	select {
+	case err := <-recvErr:
+		return err
+	default:
+		return nil
+	}
+}
+
+// every chunk of the update of the phase of a message, once it is out
+func (s *SubLinearServer) streamUpdate(ctx context.Context, data *comms.Edges) ([]*comms.Update, error) {
+	update, err := s.awaitUpdate(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+
+	updates := []*comms.Update{update}
+	for i := int32(1); i < update.GetNumChunks(); i++ {
+		req := &comms.UpdateRequest{SrcId: data.GetSrcId(), Phase: data.GetPhase(), Chunk: i, AcceptsPacked: data.GetAcceptsPacked(), JobId: data.GetJobId()}
+		chunk, err := s.FetchUpdate(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		updates = append(updates, chunk)
+	}
+	return updates, nil
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckReceivedWords(t *testing.T) {
+	node := NewNodeData(NewRemoteNodeMetaData(1, "mem-1"), &NodeBudget{words: 100})
+	s := &SubLinearServer{nodeData: node, wordLimit: 12}
+
+	s.addReceivedWords(12)
+	if err := s.checkReceivedWords(); err != nil || s.wordLimitViolations != 0 {
+		t.Fatalf("got %v and %d violations, expected S words to be within the limit", err, s.wordLimitViolations)
+	}
+
+	s.addReceivedWords(10)
+	s.addReceivedWords(3)
+	if err := s.checkReceivedWords(); err != nil || s.wordLimitViolations != 1 {
+		t.Fatalf("got %v and %d violations, expected a warning", err, s.wordLimitViolations)
+	}
+
+	// the count starts over every phase
+	s.addReceivedWords(5)
+	if err := s.checkReceivedWords(); err != nil || s.wordLimitViolations != 1 {
+		t.Fatalf("got %v and %d violations, expected the count of the last phase to be reset", err, s.wordLimitViolations)
+	}
+
+	s.strictWordLimit = true
+	s.addReceivedWords(13)
+	if err := s.checkReceivedWords(); err == nil || s.wordLimitViolations != 2 {
+		t.Fatalf("got %v and %d violations, expected the strict limit to fail", err, s.wordLimitViolations)
+	}
+	if s.totalReceivedWords != 43 {
+		t.Fatalf("got %d words in total, expected 43", s.totalReceivedWords)
+	}
+}
+
+// with a small S and a wide tree, parents receive far more than S words, and a
+// strict run fails on it
+func TestWordLimitReported(t *testing.T) {
+	graphFile := writeRandomGraph(t, 60, 400, 7)
+
+	_, err := runFlags(t, graphFile, "-transport", "channel", "-budget-policy", "report", "-fanout", "8", "-strict")
+	if err == nil || !strings.Contains(err.Error(), "words from children in phase 0, limit is 7") {
+		t.Fatalf("got %v, expected the parents to go over S = 7 words in phase 0", err)
+	}
+}
+
+// a child whose heartbeats go unanswered declares its parent dead, which is what ends
+// its wait on a stream
+func TestParentDeclaredDead(t *testing.T) {
+	parentMd := NewRemoteNodeMetaData(1, "mem-1")
+	childMd := NewRemoteNodeMetaData(2, "mem-2")
+	childMd.SetParent(parentMd)
+
+	// nothing serves the parent
+	network := NewChannelNetwork()
+	child, err := NewSubLinearServer(context.Background(), NewNodeData(childMd, &NodeBudget{words: 100}),
+		ServerConfig{jobId: "job", stream: true, liveness: LivenessConfig{interval: 10 * time.Millisecond, deadAfter: 50 * time.Millisecond}},
+		network.Transport(childMd.GetAddr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.ShutDown()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		child.sendHeartbeats(child.ctx, child.liveness.interval)
+	}()
+	if !closedWithin(done, 10*time.Second) {
+		t.Fatal("expected the child to give up on its parent")
+	}
+
+	var nodeErr *NodeError
+	if !errors.As(context.Cause(child.ctx), &nodeErr) || nodeErr.NodeId != parentMd.id {
+		t.Fatalf("got %v, expected the parent to be declared dead", context.Cause(child.ctx))
+	}
+}
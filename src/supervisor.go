@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	comms "mst/sublinear/comms"
+)
+
+type DeadChildPolicy int
+
+const (
+	// fail the run with a NodeError that names the dead child
+	AbortOnDeadChild DeadChildPolicy = iota
+	// restore the partition of a dead leaf on a standby node, from its checkpoint,
+	// and abort only if that cannot be done
+	StandbyOnDeadChild
+)
+
+func (policy DeadChildPolicy) String() string {
+	if policy == StandbyOnDeadChild {
+		return "standby"
+	}
+	return "abort"
+}
+
+func ParseDeadChildPolicy(policy string) (DeadChildPolicy, error) {
+	switch policy {
+	case "abort":
+		return AbortOnDeadChild, nil
+	case "standby":
+		return StandbyOnDeadChild, nil
+	}
+	return AbortOnDeadChild, fmt.Errorf("unknown dead child policy %q, expected abort or standby", policy)
+}
+
+// how often children send heartbeats, and how long a parent waits on a silent child
+// before declaring it dead (no heartbeats if the interval is 0)
+type LivenessConfig struct {
+	interval  time.Duration
+	deadAfter time.Duration
+	policy    DeadChildPolicy
+	standbys  StandbyPool
+}
+
+// nodes kept aside to take over dead leaves
+type StandbyPool interface {
+	// runs a standby in place of the child of parent, from the phase the parent is
+	// collecting
+	Replace(parent *NodeMetaData, childId int32, phase int32) error
+}
+
+// the liveness of the nodes of a single process. Dead leaves are taken over by
+// standbys that start will run, with the standby policy.
+func localLiveness(cfg *RunConfig, generator *NodeDataGenerator, start func(node *NodeData) error) LivenessConfig {
+	liveness := LivenessConfig{interval: cfg.heartbeat, deadAfter: cfg.deadAfter, policy: cfg.deadChildPolicy}
+	if cfg.deadChildPolicy == StandbyOnDeadChild {
+		liveness.standbys = &localStandbys{
+			left:          cfg.standbys,
+			checkpointDir: cfg.checkpointDir,
+			generator:     generator,
+			start:         start,
+		}
+	}
+	return liveness
+}
+
+// sends heartbeats up and watches the children of a node, if heartbeats are on,
+// until ctx is done
+func startLiveness(ctx context.Context, server *SubLinearServer) {
+	liveness := server.liveness
+	if liveness.interval <= 0 {
+		return
+	}
+	if server.nodeData.md.parent != nil {
+		go server.sendHeartbeats(ctx, liveness.interval)
+	}
+	if server.nodeData.md.hasChildren() {
+		go NewSupervisor(server, liveness).Run(ctx)
+	}
+}
+
+// returned by a node that was made to crash, for testing. It gives up without a word
+// to anyone, as a process that died would.
+var errCrashed = errors.New("crashed")
+
+// watches the children of a node, and declares dead those it has not heard from in
+// a while
+type Supervisor struct {
+	server *SubLinearServer
+	cfg    LivenessConfig
+}
+
+func NewSupervisor(server *SubLinearServer, cfg LivenessConfig) *Supervisor {
+	return &Supervisor{server: server, cfg: cfg}
+}
+
+func (sup *Supervisor) Run(ctx context.Context) {
+	sup.server.nodeData.md.resetLiveness(time.Now())
+
+	ticker := time.NewTicker(sup.cfg.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			sup.check(now)
+		}
+	}
+}
+
+// checks on the children once, as of now
+func (sup *Supervisor) check(now time.Time) {
+	for childId, silence := range sup.server.nodeData.md.silentChildren(sup.cfg.deadAfter, now) {
+		sup.declareDead(childId, silence)
+	}
+}
+
+func (sup *Supervisor) declareDead(childId int32, silence time.Duration) {
+	s := sup.server
+	md := s.nodeData.md
+	phase, _ := s.nodeData.getUpdate()
+	phase++
+	log.Printf("[ERROR] %d - child %d declared dead in phase %d, not heard from for %v", md.id, childId, phase, silence.Round(time.Millisecond))
+
+	if sup.cfg.policy == StandbyOnDeadChild {
+		err := sup.cfg.standbys.Replace(md, childId, phase)
+		if err == nil {
+			log.Printf("[INFO] %d - child %d taken over by a standby node", md.id, childId)
+			md.markAlive(childId)
+			return
+		}
+		log.Printf("[ERROR] %d - failed to take over child %d: %v", md.id, childId, err)
+	}
+
+	s.cancel(&NodeError{
+		NodeId: childId,
+		Phase:  phase,
+		Reason: fmt.Sprintf("declared dead by parent %d, not heard from for %v", md.id, silence.Round(time.Millisecond)),
+	})
+}
+
+// tells the parent the node is alive, until ctx is done. A parent that has not
+// answered in deadAfter is declared dead, as it would declare a silent child, which
+// is what ends a wait on a stream that has no deadline.
+func (s *SubLinearServer) sendHeartbeats(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	parent := s.nodeData.md.parent
+	lastAnswer := time.Now()
+	for {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-ticker.C:
+		}
+
+		req := &comms.HeartbeatRequest{SrcId: s.nodeData.md.id, Phase: s.nodeData.md.getPhase(), JobId: s.jobId}
+		hbCtx, cancel := context.WithTimeout(ctx, interval)
+		err := s.transport.Heartbeat(hbCtx, parent, req)
+		cancel()
+		if err == nil {
+			lastAnswer = now
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("[WARN] %d - heartbeat to parent %d failed: %v", s.nodeData.md.id, parent.id, err)
+
+		if silence := now.Sub(lastAnswer); s.liveness.deadAfter > 0 && silence > s.liveness.deadAfter {
+			log.Printf("[ERROR] %d - parent %d declared dead in phase %d, not heard from for %v", s.nodeData.md.id, parent.id, req.GetPhase(), silence.Round(time.Millisecond))
+			s.cancel(&NodeError{
+				NodeId: parent.id,
+				Phase:  req.GetPhase(),
+				Reason: fmt.Sprintf("declared dead by child %d, not heard from for %v", s.nodeData.md.id, silence.Round(time.Millisecond)),
+			})
+			return
+		}
+	}
+}
+
+// --- standby nodes of a single process ---
+
+// standby nodes of a single process, which take over dead leaves from their last
+// checkpoint
+type localStandbys struct {
+	mutex         sync.Mutex
+	left          int
+	checkpointDir string
+	generator     *NodeDataGenerator
+	// creates and runs the server of a node
+	start func(node *NodeData) error
+}
+
+func (pool *localStandbys) Replace(parent *NodeMetaData, childId int32, phase int32) error {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	if pool.left == 0 {
+		return fmt.Errorf("no standby nodes left")
+	}
+
+	// a leaf saves its state before it sends its edges, so if it died before saving
+	// that of this phase, it is resent the update of the phase before
+	cp, err := lastCheckpoint(pool.checkpointDir, childId, phase)
+	if err != nil {
+		return err
+	}
+	if cp.Phase < phase-1 {
+		return fmt.Errorf("last checkpoint of node %d is of phase %d, too old for phase %d", childId, cp.Phase, phase)
+	}
+	if len(cp.Children) > 0 {
+		return fmt.Errorf("node %d is not a leaf, its children only know its address", childId)
+	}
+
+	node, err := pool.generator.CreateStandby(childId)
+	if err != nil {
+		return err
+	}
+	node.md.SetParent(parent)
+	if err := restoreNode(node, cp); err != nil {
+		return err
+	}
+	if err := pool.start(node); err != nil {
+		return err
+	}
+
+	pool.left--
+	log.Printf("[INFO] standby %s took over node %d from its checkpoint of phase %d, %d standby nodes left",
+		node.md.GetAddr(), childId, cp.Phase, pool.left)
+	return nil
+}
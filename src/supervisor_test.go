@@ -0,0 +1,45 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// a leaf crashes in each of a few phases, and is declared dead by its parent
+func TestDeadChild(t *testing.T) {
+	graphFile := writeRandomGraph(t, 60, 400, 9)
+
+	for _, crash := range []string{"2:0", "2:1", "4:2"} {
+		args := []string{
+			"-transport", "channel", "-budget-policy", "report", "-checkpoint-dir", filepath.Join(t.TempDir(), "checkpoints"),
+			"-heartbeat", "20ms", "-dead-after", "500ms", "-crash", crash,
+		}
+		id, phase, _ := strings.Cut(crash, ":")
+
+		t.Run("standby-"+crash, func(t *testing.T) {
+			// a standby takes over the leaf from its checkpoint, and the run carries on
+			outFile, err := runFlags(t, graphFile, append(args, "-dead-child", "standby")...)
+			if err != nil {
+				t.Fatalf("expected a standby to take over the crashed leaf: %v", err)
+			}
+			if err := checkForest(graphFile, outFile); err != nil {
+				t.Fatal(err)
+			}
+		})
+
+		t.Run("standby-none-left-"+crash, func(t *testing.T) {
+			_, err := runFlags(t, graphFile, append(args, "-dead-child", "standby", "-standbys", "0")...)
+			if err == nil || !strings.Contains(err.Error(), "node "+id+" failed in phase "+phase+": declared dead") {
+				t.Fatalf("got %v, expected the run to fail without a standby", err)
+			}
+		})
+
+		t.Run("abort-"+crash, func(t *testing.T) {
+			_, err := runFlags(t, graphFile, append(args, "-dead-child", "abort")...)
+			if err == nil || !strings.Contains(err.Error(), "node "+id+" failed in phase "+phase+": declared dead") {
+				t.Fatalf("got %v, expected the run to fail, naming the crashed leaf", err)
+			}
+		})
+	}
+}
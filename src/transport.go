@@ -0,0 +1,565 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+
+	comms "mst/sublinear/comms"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+// how a node talks to the rest of the tree: it serves its children, and sends its
+// edges up to its parent
+type Transport interface {
+	// serves the handler to the children of the node, blocking until stopped
+	Serve(handler comms.EdgeDataServiceServer) error
+	// stops serving, once the handlers in flight are done
+	Stop()
+	// sends edges up to the parent, blocking until its update comes back down
+	SendUp(ctx context.Context, parent *NodeMetaData, edges *comms.Edges) (*comms.Update, error)
+	// fetches a further chunk of the update from the parent
+	FetchUpdate(ctx context.Context, parent *NodeMetaData, req *comms.UpdateRequest) (*comms.Update, error)
+	// tells the parent that the node is still alive
+	Heartbeat(ctx context.Context, parent *NodeMetaData, req *comms.HeartbeatRequest) error
+	// the connections opened to the parent so far
+	ConnStats() ConnStats
+}
+
+type ConnStats struct {
+	// connections dialled to the parent, including reconnects
+	Dials int
+	// connections dialled to replace a broken one
+	Reconnects int
+}
+
+// options of the gRPC transports
+type TransportConfig struct {
+	// send edges up over a single stream per child, instead of a call per phase
+	stream bool
+	// messages either way are capped at the bytes of this many words
+	maxMessageWords int
+	// if set, nodes talk over mutual TLS with the certificates in this directory
+	certsDir string
+	// if set, faults are injected into the PropogateUp calls, for chaos testing
+	faults *FaultPolicy
+}
+
+// the tls config of a node, or nil without certificates
+func (cfg TransportConfig) nodeTLS(id int32) (*tls.Config, error) {
+	if cfg.certsDir == "" {
+		return nil, nil
+	}
+	return loadNodeTLS(cfg.certsDir, id)
+}
+
+// creates the transport of a node
+type TransportFactory func(md *NodeMetaData) (Transport, error)
+
+func NewTransportFactory(kind string, cfg TransportConfig) (TransportFactory, error) {
+	switch kind {
+	case "grpc":
+		return func(md *NodeMetaData) (Transport, error) {
+			if md.lis == nil {
+				return nil, fmt.Errorf("node %d is not listening", md.id)
+			}
+			tlsConfig, err := cfg.nodeTLS(md.id)
+			if err != nil {
+				return nil, err
+			}
+			return NewGrpcTransport(md.lis, cfg, tlsConfig), nil
+		}, nil
+	case "channel":
+		if cfg.certsDir != "" {
+			return nil, fmt.Errorf("the channel transport does not use TLS, pick grpc or bufconn")
+		}
+		if cfg.faults != nil {
+			return nil, fmt.Errorf("faults are injected by gRPC interceptors, pick grpc or bufconn")
+		}
+		if cfg.stream {
+			return nil, fmt.Errorf("the channel transport has no streams, pick grpc or bufconn")
+		}
+		network := NewChannelNetwork()
+		return func(md *NodeMetaData) (Transport, error) {
+			return network.Transport(md.GetAddr()), nil
+		}, nil
+	case "bufconn":
+		network := NewBufconnNetwork()
+		return func(md *NodeMetaData) (Transport, error) {
+			tlsConfig, err := cfg.nodeTLS(md.id)
+			if err != nil {
+				return nil, err
+			}
+			return network.Transport(md.GetAddr(), cfg, tlsConfig), nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown transport %q, expected grpc, channel or bufconn", kind)
+}
+
+// --- gRPC ---
+
+type GrpcTransport struct {
+	lis      net.Listener
+	server   *grpc.Server
+	dialOpts []grpc.DialOption
+	// the target to dial to reach a node
+	target func(md *NodeMetaData) string
+	// nil for plaintext
+	tlsConfig *tls.Config
+
+	// a single connection to the parent, kept for the whole run
+	connMutex sync.Mutex
+	conn      *grpc.ClientConn
+	connStats ConnStats
+
+	// if set, edges go up over a single stream for the whole run, instead of a call
+	// per phase
+	stream       bool
+	upStream     comms.EdgeDataService_PropogateStreamClient
+	cancelStream context.CancelFunc
+}
+
+// messages either way are capped at the bytes of maxMessageWords words, so gRPC
+// rejects anything that slips past the chunking. Edges go up with a checksum, which
+// the parent checks them against. With a tls config, children must present a
+// certificate, and may only send messages as the node it was issued to.
+func NewGrpcTransport(lis net.Listener, cfg TransportConfig, tlsConfig *tls.Config) *GrpcTransport {
+	maxBytes := maxMessageBytes(cfg.maxMessageWords)
+	serverOpts := []grpc.ServerOption{grpc.MaxSendMsgSize(maxBytes), grpc.MaxRecvMsgSize(maxBytes)}
+	if tlsConfig != nil {
+		serverOpts = append(serverOpts,
+			grpc.Creds(credentials.NewTLS(tlsConfig)),
+			grpc.ChainUnaryInterceptor(verifyPeerUnary),
+			grpc.ChainStreamInterceptor(verifyPeerStream),
+		)
+	}
+	dialOpts := []grpc.DialOption{
+		grpc.WithDefaultCallOptions(grpc.MaxCallSendMsgSize(maxBytes), grpc.MaxCallRecvMsgSize(maxBytes)),
+		grpc.WithChainUnaryInterceptor(checksumUnaryClient),
+	}
+	if cfg.faults != nil {
+		// after the peer is verified, so the faults hit what the handler would see,
+		// and after the checksum is worked out, as they happen on the way
+		serverOpts = append(serverOpts, grpc.ChainUnaryInterceptor(cfg.faults.UnaryServerInterceptor))
+		dialOpts = append(dialOpts, grpc.WithChainUnaryInterceptor(cfg.faults.UnaryClientInterceptor))
+	}
+	serverOpts = append(serverOpts, grpc.ChainUnaryInterceptor(verifyChecksumUnary))
+
+	return &GrpcTransport{
+		lis:       lis,
+		server:    grpc.NewServer(serverOpts...),
+		dialOpts:  dialOpts,
+		target:    func(md *NodeMetaData) string { return md.GetAddr() },
+		tlsConfig: tlsConfig,
+		stream:    cfg.stream,
+	}
+}
+
+func (t *GrpcTransport) Serve(handler comms.EdgeDataServiceServer) error {
+	comms.RegisterEdgeDataServiceServer(t.server, handler)
+
+	// a node without children may be done (and stopped) before it gets to serve
+	if err := t.server.Serve(t.lis); err != nil && err != grpc.ErrServerStopped {
+		return err
+	}
+	return nil
+}
+
+func (t *GrpcTransport) Stop() {
+	t.server.GracefulStop()
+
+	t.connMutex.Lock()
+	defer t.connMutex.Unlock()
+
+	if t.upStream != nil {
+		// let the parent see the end of the stream before it goes
+		if err := t.upStream.CloseSend(); err == nil {
+			_, _ = t.upStream.Recv()
+		}
+		t.cancelStream()
+		t.upStream = nil
+	}
+	if t.conn != nil {
+		t.conn.Close()
+		t.conn = nil
+	}
+}
+
+// the connection to the parent, dialling a new one if there is none yet or if the
+// current one is broken
+func (t *GrpcTransport) parentConn(parent *NodeMetaData) (*grpc.ClientConn, error) {
+	t.connMutex.Lock()
+	defer t.connMutex.Unlock()
+
+	if t.conn != nil {
+		state := t.conn.GetState()
+		if state != connectivity.Shutdown && state != connectivity.TransientFailure {
+			return t.conn, nil
+		}
+
+		// grpc would retry a failing connection with backoff, but the parent may well
+		// be back already, so start over with a fresh one
+		log.Printf("%s - connection to parent %d is %s, reconnecting", t.lis.Addr(), parent.id, state)
+		t.conn.Close()
+		t.conn = nil
+		t.connStats.Reconnects++
+	}
+
+	creds := insecure.NewCredentials()
+	if t.tlsConfig != nil {
+		// the parent must present the certificate of its own node id
+		tlsConfig := t.tlsConfig.Clone()
+		tlsConfig.ServerName = nodeName(parent.id)
+		creds = &loggedCreds{TransportCredentials: credentials.NewTLS(tlsConfig), parentId: parent.id}
+	}
+
+	dialOpts := append([]grpc.DialOption{grpc.WithTransportCredentials(creds)}, t.dialOpts...)
+	conn, err := grpc.NewClient(t.target(parent), dialOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create client connection: %v", err)
+	}
+	t.conn = conn
+	t.connStats.Dials++
+
+	return conn, nil
+}
+
+func (t *GrpcTransport) SendUp(ctx context.Context, parent *NodeMetaData, edges *comms.Edges) (*comms.Update, error) {
+	conn, err := t.parentConn(parent)
+	if err != nil {
+		return nil, err
+	}
+
+	var update *comms.Update
+	if t.stream {
+		update, err = t.sendOnStream(ctx, conn, edges)
+	} else {
+		// the parent may be a separate process that is not serving yet
+		update, err = comms.NewEdgeDataServiceClient(conn).PropogateUp(ctx, edges, grpc.WaitForReady(true))
+	}
+	if status.Code(err) == codes.Unavailable {
+		// the connection broke mid call, so the next phase reconnects
+		conn.Close()
+	}
+
+	return update, err
+}
+
+// the stream to the parent, opened on the first phase
+func (t *GrpcTransport) parentStream(conn *grpc.ClientConn) (comms.EdgeDataService_PropogateStreamClient, error) {
+	t.connMutex.Lock()
+	defer t.connMutex.Unlock()
+
+	if t.upStream != nil {
+		return t.upStream, nil
+	}
+
+	// the stream outlives the calls of every phase, so it gets a context of its own
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := comms.NewEdgeDataServiceClient(conn).PropogateStream(ctx, grpc.WaitForReady(true))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	t.upStream = stream
+	t.cancelStream = cancel
+
+	return stream, nil
+}
+
+// drops a broken stream, so the next phase opens a new one
+func (t *GrpcTransport) dropStream() {
+	t.connMutex.Lock()
+	defer t.connMutex.Unlock()
+
+	if t.upStream != nil {
+		t.cancelStream()
+		t.upStream = nil
+	}
+}
+
+func (t *GrpcTransport) sendOnStream(ctx context.Context, conn *grpc.ClientConn, edges *comms.Edges) (*comms.Update, error) {
+	stream, err := t.parentStream(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream: %v", err)
+	}
+
+	if err := stream.Send(edges); err != nil {
+		t.dropStream()
+		return nil, err
+	}
+
+	return t.recvOnStream(ctx, stream, edges.GetPhase())
+}
+
+// the next update the parent pushed on the stream, which must be of the given phase
+func (t *GrpcTransport) recvOnStream(ctx context.Context, stream comms.EdgeDataService_PropogateStreamClient, phase int32) (*comms.Update, error) {
+	// Recv does not take a context, so wait for it on the side
+	replies := make(chan updateReply, 1)
+	go func() {
+		update, err := stream.Recv()
+		replies <- updateReply{update: update, err: err}
+	}()
+
+	select {
+	case reply := <-replies:
+		if reply.err != nil {
+			t.dropStream()
+			return nil, reply.err
+		}
+		if reply.update.GetPhase() != phase {
+			t.dropStream()
+			return nil, fmt.Errorf("received the update of phase %d in phase %d", reply.update.GetPhase(), phase)
+		}
+		return reply.update, nil
+	case <-ctx.Done():
+		// cancelling the stream also ends the Recv
+		t.dropStream()
+		return nil, ctx.Err()
+	}
+}
+
+// over a stream, the parent pushes the rest of the chunks without being asked. If the
+// stream broke on the way, the chunk is fetched by a call of its own.
+func (t *GrpcTransport) FetchUpdate(ctx context.Context, parent *NodeMetaData, req *comms.UpdateRequest) (*comms.Update, error) {
+	if t.stream {
+		t.connMutex.Lock()
+		stream := t.upStream
+		t.connMutex.Unlock()
+
+		if stream != nil {
+			return t.recvOnStream(ctx, stream, req.GetPhase())
+		}
+	}
+
+	conn, err := t.parentConn(parent)
+	if err != nil {
+		return nil, err
+	}
+
+	update, err := comms.NewEdgeDataServiceClient(conn).FetchUpdate(ctx, req, grpc.WaitForReady(true))
+	if status.Code(err) == codes.Unavailable {
+		conn.Close()
+	}
+
+	return update, err
+}
+
+// heartbeats fail fast rather than wait for the parent, so a missed one is not sent late
+func (t *GrpcTransport) Heartbeat(ctx context.Context, parent *NodeMetaData, req *comms.HeartbeatRequest) error {
+	conn, err := t.parentConn(parent)
+	if err != nil {
+		return err
+	}
+
+	_, err = comms.NewEdgeDataServiceClient(conn).Heartbeat(ctx, req)
+	return err
+}
+
+func (t *GrpcTransport) ConnStats() ConnStats {
+	t.connMutex.Lock()
+	defer t.connMutex.Unlock()
+
+	return t.connStats
+}
+
+// --- bufconn ---
+
+// size of the in-memory buffer of every bufconn connection
+const bufconnSize = 1 << 20
+
+// in-memory listeners, keyed by the address of their node, so the full gRPC stack
+// runs without opening a single port
+type BufconnNetwork struct {
+	listenersMutex sync.Mutex
+	listeners      map[string]*bufconn.Listener
+}
+
+func NewBufconnNetwork() *BufconnNetwork {
+	return &BufconnNetwork{listeners: make(map[string]*bufconn.Listener)}
+}
+
+// the listener of an address, created on first use so a child may dial its parent
+// before the parent is serving
+func (network *BufconnNetwork) listener(addr string) *bufconn.Listener {
+	network.listenersMutex.Lock()
+	defer network.listenersMutex.Unlock()
+
+	lis, ok := network.listeners[addr]
+	if !ok {
+		lis = bufconn.Listen(bufconnSize)
+		network.listeners[addr] = lis
+	}
+	return lis
+}
+
+func (network *BufconnNetwork) Transport(addr string, cfg TransportConfig, tlsConfig *tls.Config) *GrpcTransport {
+	t := NewGrpcTransport(network.listener(addr), cfg, tlsConfig)
+	t.dialOpts = append(t.dialOpts, grpc.WithContextDialer(func(ctx context.Context, target string) (net.Conn, error) {
+		return network.listener(target).DialContext(ctx)
+	}))
+	t.target = func(md *NodeMetaData) string { return "passthrough:///" + md.GetAddr() }
+	return t
+}
+
+// --- channel ---
+
+type updateReply struct {
+	update *comms.Update
+	err    error
+}
+
+type channelRequest struct {
+	call  func(handler comms.EdgeDataServiceServer) (*comms.Update, error)
+	reply chan updateReply
+}
+
+// inboxes of requests, keyed by the address of their node, for nodes that run as
+// goroutines of a single process and skip gRPC altogether
+type ChannelNetwork struct {
+	inboxesMutex sync.Mutex
+	inboxes      map[string]*channelInbox
+}
+
+// the requests to a node, and a channel closed once it stops taking them
+type channelInbox struct {
+	requests chan channelRequest
+	stopped  chan struct{}
+}
+
+func NewChannelNetwork() *ChannelNetwork {
+	return &ChannelNetwork{inboxes: make(map[string]*channelInbox)}
+}
+
+// the inbox of an address, created on first use so a child may send to its parent
+// before the parent is serving
+func (network *ChannelNetwork) inbox(addr string) *channelInbox {
+	network.inboxesMutex.Lock()
+	defer network.inboxesMutex.Unlock()
+
+	inbox, ok := network.inboxes[addr]
+	if !ok {
+		inbox = &channelInbox{requests: make(chan channelRequest), stopped: make(chan struct{})}
+		network.inboxes[addr] = inbox
+	}
+	return inbox
+}
+
+func (network *ChannelNetwork) Transport(addr string) *ChannelTransport {
+	return &ChannelTransport{network: network, inbox: network.inbox(addr)}
+}
+
+type ChannelTransport struct {
+	network *ChannelNetwork
+	inbox   *channelInbox
+	// taken to start a handler and to stop, so that Stop waits for every handler
+	// started before it, and none starts after
+	stopMutex sync.Mutex
+	stopping  bool
+	inFlight  sync.WaitGroup
+}
+
+func (t *ChannelTransport) Serve(handler comms.EdgeDataServiceServer) error {
+	for {
+		select {
+		case <-t.inbox.stopped:
+			return nil
+		case req := <-t.inbox.requests:
+			t.stopMutex.Lock()
+			if t.stopping {
+				t.stopMutex.Unlock()
+				req.reply <- updateReply{err: errStopped}
+				return nil
+			}
+			t.inFlight.Add(1)
+			t.stopMutex.Unlock()
+
+			go func() {
+				defer t.inFlight.Done()
+
+				update, err := req.call(handler)
+				req.reply <- updateReply{update: update, err: err}
+			}()
+		}
+	}
+}
+
+func (t *ChannelTransport) Stop() {
+	t.stopMutex.Lock()
+	if !t.stopping {
+		t.stopping = true
+		close(t.inbox.stopped)
+	}
+	t.stopMutex.Unlock()
+
+	t.inFlight.Wait()
+}
+
+// channels need no connections
+func (t *ChannelTransport) ConnStats() ConnStats {
+	return ConnStats{}
+}
+
+// what a call to a node that stopped fails with, as it would over gRPC
+var errStopped = status.Error(codes.Unavailable, "node has stopped")
+
+// makes a call on the handler of the parent, as if it went over the wire
+func (t *ChannelTransport) callParent(ctx context.Context, parent *NodeMetaData, call func(handler comms.EdgeDataServiceServer) (*comms.Update, error)) (*comms.Update, error) {
+	req := channelRequest{call: call, reply: make(chan updateReply, 1)}
+
+	// a parent that stopped takes no more requests, so fail fast rather than wait
+	inbox := t.network.inbox(parent.GetAddr())
+	select {
+	case inbox.requests <- req:
+	case <-inbox.stopped:
+		return nil, errStopped
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	select {
+	case reply := <-req.reply:
+		if reply.err != nil {
+			return nil, reply.err
+		}
+		return proto.Clone(reply.update).(*comms.Update), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (t *ChannelTransport) SendUp(ctx context.Context, parent *NodeMetaData, edges *comms.Edges) (*comms.Update, error) {
+	// clone the messages both ways, so neither side shares them with the other
+	edges = proto.Clone(edges).(*comms.Edges)
+	return t.callParent(ctx, parent, func(handler comms.EdgeDataServiceServer) (*comms.Update, error) {
+		return handler.PropogateUp(ctx, edges)
+	})
+}
+
+func (t *ChannelTransport) FetchUpdate(ctx context.Context, parent *NodeMetaData, req *comms.UpdateRequest) (*comms.Update, error) {
+	req = proto.Clone(req).(*comms.UpdateRequest)
+	return t.callParent(ctx, parent, func(handler comms.EdgeDataServiceServer) (*comms.Update, error) {
+		return handler.FetchUpdate(ctx, req)
+	})
+}
+
+func (t *ChannelTransport) Heartbeat(ctx context.Context, parent *NodeMetaData, req *comms.HeartbeatRequest) error {
+	req = proto.Clone(req).(*comms.HeartbeatRequest)
+	_, err := t.callParent(ctx, parent, func(handler comms.EdgeDataServiceServer) (*comms.Update, error) {
+		// the reply carries nothing the child needs
+		_, err := handler.Heartbeat(ctx, req)
+		return &comms.Update{}, err
+	})
+	return err
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	comms "mst/sublinear/comms"
+	utils "mst/sublinear/utils"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// the in-memory transports, which need no ports
+var inMemoryTransports = []string{"channel", "bufconn"}
+
+func TestMain(m *testing.M) {
+	// every node logs every phase, which would drown the test output
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// writes a connected random graph of n vertices and m edges, with no self-loops or
+// parallel edges
+func writeRandomGraph(tb testing.TB, n, m int, seed int64) string {
+	rng := rand.New(rand.NewSource(seed))
+	seen := make(map[[2]int32]bool)
+	edges := []*utils.Edge{}
+	addEdge := func(u, v int32) {
+		key := [2]int32{min(u, v), max(u, v)}
+		if u == v || seen[key] {
+			return
+		}
+		seen[key] = true
+		edges = append(edges, utils.NewEdge(u, v, int32(rng.Intn(1000))+1))
+	}
+
+	// a random spanning tree keeps the graph connected
+	for v := 1; v < n; v++ {
+		addEdge(int32(rng.Intn(v)), int32(v))
+	}
+	for len(edges) < m {
+		addEdge(int32(rng.Intn(n)), int32(rng.Intn(n)))
+	}
+
+	graphFile := filepath.Join(tb.TempDir(), "graph.txt")
+	if err := utils.WriteGraph(graphFile, edges); err != nil {
+		tb.Fatalf("failed to write graph: %v", err)
+	}
+	return graphFile
+}
+
+// runs the whole tree in this process with the flags, as the command line would,
+// returning the output file and the error of the run
+func runFlags(tb testing.TB, graphFile string, args ...string) (string, error) {
+	outFile := filepath.Join(tb.TempDir(), "out.txt")
+	return outFile, runFlagsTo(tb, graphFile, outFile, args...)
+}
+
+// runs the whole tree with the flags, writing the forest to outFile
+func runFlagsTo(tb testing.TB, graphFile, outFile string, args ...string) error {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	buildConfig := addRunFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		tb.Fatalf("failed to parse flags: %v", err)
+	}
+	cfg, err := buildConfig(0.5)
+	if err != nil {
+		tb.Fatalf("failed to build config: %v", err)
+	}
+
+	return calcMST(graphFile, outFile, cfg)
+}
+
+// runs the whole tree over the transport, failing the test if the run fails
+func runTransport(tb testing.TB, graphFile, transport string, args ...string) string {
+	// parents hold more than the budget of a leaf, which is only reported
+	flags := append([]string{"-transport", transport, "-budget-policy", "report"}, args...)
+	outFile, err := runFlags(tb, graphFile, flags...)
+	if err != nil {
+		tb.Fatalf("%s run failed: %v", transport, err)
+	}
+	return outFile
+}
+
+func TestCalcMSTInMemory(t *testing.T) {
+	graphFile := writeRandomGraph(t, 60, 400, 7)
+
+	cases := []struct {
+		name      string
+		transport string
+		args      []string
+	}{
+		{"channel", "channel", nil},
+		{"bufconn", "bufconn", nil},
+		{"bufconn-packed", "bufconn", []string{"-packed"}},
+		{"bufconn-stream", "bufconn", []string{"-stream"}},
+		// the parent pushes the chunks of every update down the stream
+		{"bufconn-stream-chunked", "bufconn", []string{"-stream", "-max-message-words", "14"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			outFile := runTransport(t, graphFile, tc.transport, tc.args...)
+			if err := checkForest(graphFile, outFile); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// a handler whose heartbeats wait to be released, and count when they are done
+type heldHandler struct {
+	comms.UnimplementedEdgeDataServiceServer
+	release chan struct{}
+	mutex   sync.Mutex
+	done    int
+}
+
+func (h *heldHandler) Heartbeat(ctx context.Context, req *comms.HeartbeatRequest) (*comms.HeartbeatReply, error) {
+	<-h.release
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.done++
+	return &comms.HeartbeatReply{}, nil
+}
+
+// Stop waits for the calls in flight, even those that come in as it stops, and calls
+// after it fail fast
+func TestChannelTransportStop(t *testing.T) {
+	network := NewChannelNetwork()
+	parentMd := NewRemoteNodeMetaData(1, "mem-1")
+	parent := network.Transport(parentMd.GetAddr())
+	child := network.Transport("mem-2")
+
+	handler := &heldHandler{release: make(chan struct{})}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		if err := parent.Serve(handler); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// calls race Stop, each either handled in full or turned away
+	const numCalls = 50
+	var wg sync.WaitGroup
+	var errsMutex sync.Mutex
+	turnedAway := 0
+	for range numCalls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := child.Heartbeat(ctx, parentMd, &comms.HeartbeatRequest{})
+			if err != nil {
+				if status.Code(err) != codes.Unavailable {
+					t.Errorf("got %v, expected the call to be turned away", err)
+				}
+				errsMutex.Lock()
+				turnedAway++
+				errsMutex.Unlock()
+			}
+		}()
+	}
+	time.Sleep(settle)
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		parent.Stop()
+	}()
+	if closedWithin(stopped, settle) {
+		t.Fatal("expected Stop to wait for the calls in flight")
+	}
+	close(handler.release)
+	if !closedWithin(stopped, 10*time.Second) || !closedWithin(served, 10*time.Second) {
+		t.Fatal("expected Stop to return once the calls in flight are done")
+	}
+	wg.Wait()
+
+	if handler.done+turnedAway != numCalls {
+		t.Fatalf("%d calls were handled and %d turned away, expected %d in all", handler.done, turnedAway, numCalls)
+	}
+	if handler.done == 0 {
+		t.Fatal("expected the calls in flight before Stop to be handled")
+	}
+
+	// with no deadline, a call to a parent that stopped still returns straight away
+	err := child.Heartbeat(context.Background(), parentMd, &comms.HeartbeatRequest{})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("got %v, expected a call to a stopped parent to fail", err)
+	}
+}
+
+func BenchmarkCalcMST(b *testing.B) {
+	graphFile := writeRandomGraph(b, 145, 3000, 42)
+
+	for _, transport := range inMemoryTransports {
+		b.Run(transport, func(b *testing.B) {
+			var outFile string
+			for i := 0; i < b.N; i++ {
+				outFile = runTransport(b, graphFile, transport)
+			}
+
+			b.StopTimer()
+			if err := checkForest(graphFile, outFile); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
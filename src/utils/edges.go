@@ -2,9 +2,11 @@ package utils
 
 import (
 	"bufio"
+	"cmp"
 	"fmt"
 	"math"
 	"os"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -28,6 +30,30 @@ func NewEdge(src, dest, weight int32) *Edge {
 	}
 }
 
+// the endpoints of the edge, smallest first
+func (edge *Edge) endpoints() (int32, int32) {
+	if edge.U < edge.V {
+		return edge.U, edge.V
+	}
+	return edge.V, edge.U
+}
+
+// the canonical total order on edges: by weight, then by the smaller endpoint and
+// then by the larger one. An edge compares equal to itself in either orientation,
+// so every node picks the same moe even when weights are duplicated.
+func CompareEdges(a, b *Edge) int {
+	if a.Weight != b.Weight {
+		return cmp.Compare(a.Weight, b.Weight)
+	}
+
+	aLow, aHigh := a.endpoints()
+	bLow, bHigh := b.endpoints()
+	if aLow != bLow {
+		return cmp.Compare(aLow, bLow)
+	}
+	return cmp.Compare(aHigh, bHigh)
+}
+
 func GetNumberOfVertices(edges []Edge) (int, error) {
 	uniqueVertices := make(map[int32]bool)
 
@@ -69,44 +95,60 @@ func GetStats(edges []*Edge) (int, int, int) {
 }
 
 func ReadGraph(fileName string) ([]*Edge, error) {
+	edges, _, err := readEdgeFile(fileName, false)
+	return edges, err
+}
+
+// reads a forest written by WriteForest, along with the component of each edge
+func ReadForest(fileName string) ([]*Edge, []int32, error) {
+	return readEdgeFile(fileName, true)
+}
+
+func readEdgeFile(fileName string, withComponents bool) ([]*Edge, []int32, error) {
 	file, err := os.Open(fileName)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer file.Close()
 
+	numFields := 3
+	if withComponents {
+		numFields = 4
+	}
+
 	var edges []*Edge
+	var components []int32
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		parts := strings.Fields(scanner.Text())
-		if len(parts) != 3 {
-			return nil, fmt.Errorf("invalid line: %s", scanner.Text())
+		if len(parts) != numFields {
+			return nil, nil, fmt.Errorf("invalid line: %s", scanner.Text())
 		}
 
-		src, err1 := strconv.Atoi(parts[0])
-		dest, err2 := strconv.Atoi(parts[1])
-		weight, err3 := strconv.Atoi(parts[2])
-
-		if err1 != nil || err2 != nil || err3 != nil {
-			return nil, fmt.Errorf("invalid line: %s", scanner.Text())
+		values := make([]int32, numFields)
+		for i, part := range parts {
+			value, err := strconv.Atoi(part)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid line: %s", scanner.Text())
+			}
+			values[i] = int32(value)
 		}
 
-		edges = append(edges, NewEdge(int32(src), int32(dest), int32(weight)))
+		edges = append(edges, NewEdge(values[0], values[1], values[2]))
+		if withComponents {
+			components = append(components, values[3])
+		}
 	}
 
 	if err = scanner.Err(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return edges, nil
+	return edges, components, nil
 }
 
 func SortEdges(edges []*Edge) {
-	sort.Slice(edges, func(i, j int) bool {
-		return (edges[i].Weight < edges[j].Weight) ||
-			(edges[i].Weight == edges[j].Weight && edges[i].U < edges[j].U) ||
-			(edges[i].Weight == edges[j].Weight && edges[i].U == edges[j].U && edges[i].V < edges[j].V)
-	})
+	slices.SortFunc(edges, CompareEdges)
 }
 
 func WriteGraph(fileName string, edges []*Edge) error {
@@ -128,3 +170,28 @@ func WriteGraph(fileName string, edges []*Edge) error {
 
 	return writer.Flush()
 }
+
+// overwrites the file with the forest, grouped by component, with the id of
+// the component of each edge as a fourth column
+func WriteForest(fileName string, edges []*Edge, components map[int32]int32) error {
+	SortEdges(edges)
+	sort.SliceStable(edges, func(i, j int) bool {
+		return components[edges[i].U] < components[edges[j].U]
+	})
+
+	file, err := os.OpenFile(fileName, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	for _, edge := range edges {
+		_, err := fmt.Fprintf(writer, "%d %d %d %d\n", edge.U, edge.V, edge.Weight, components[edge.U])
+		if err != nil {
+			return err
+		}
+	}
+
+	return writer.Flush()
+}
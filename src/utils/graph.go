@@ -1,5 +1,7 @@
 package utils
 
+import "slices"
+
 type EdgeTarget struct {
 	v      int32
 	Weight int32
@@ -22,10 +24,11 @@ func getMinOutgoingEdge(src int32, targets []EdgeTarget, fragmentIds map[int32]i
 		if fragmentIds[src] == fragmentIds[target.v] {
 			continue
 		}
-		if minEdge != nil && minEdge.Weight <= target.Weight {
+		edge := NewEdge(src, target.v, target.Weight)
+		if minEdge != nil && CompareEdges(minEdge, edge) <= 0 {
 			continue
 		}
-		minEdge = NewEdge(src, target.v, target.Weight)
+		minEdge = edge
 	}
 
 	return minEdge
@@ -42,7 +45,7 @@ func GetMoEs(adjacencyList map[int32][]EdgeTarget, fragmentIds map[int32]int32)
 		}
 
 		fragment := fragmentIds[minEdge.U]
-		if currMin, ok := fragToMoe[fragment]; !ok || currMin.Weight > minEdge.Weight {
+		if currMin, ok := fragToMoe[fragment]; !ok || CompareEdges(minEdge, currMin) < 0 {
 			fragToMoe[fragment] = minEdge
 		}
 	}
@@ -64,3 +67,80 @@ func GetEdgeList(adjacencyList map[int32][]EdgeTarget) []*Edge {
 	}
 	return edges
 }
+
+// labels every vertex with the id of its connected component, which is the
+// smallest vertex id within that component
+func GetComponents(edges []*Edge) map[int32]int32 {
+	ds := NewDisjointSet()
+	for _, edge := range edges {
+		ds.Union(edge.U, edge.V)
+	}
+
+	minVertex := make(map[int32]int32)
+	for _, edge := range edges {
+		for _, vertex := range []int32{edge.U, edge.V} {
+			root := ds.Find(vertex)
+			if curr, ok := minVertex[root]; !ok || vertex < curr {
+				minVertex[root] = vertex
+			}
+		}
+	}
+
+	components := make(map[int32]int32)
+	for _, edge := range edges {
+		for _, vertex := range []int32{edge.U, edge.V} {
+			components[vertex] = minVertex[ds.Find(vertex)]
+		}
+	}
+
+	return components
+}
+
+// a minimum spanning forest of the edges, over the fragments their endpoints belong
+// to. By the cycle property, an edge that closes a cycle (or lies within a single
+// fragment) is the heaviest edge on that cycle and can never be part of the mst.
+func GetLocalMSF(edges []*Edge, fragmentIds map[int32]int32) []*Edge {
+	sorted := slices.Clone(edges)
+	SortEdges(sorted)
+
+	ds := NewDisjointSet()
+	forest := make([]*Edge, 0)
+	for _, edge := range sorted {
+		if !ds.Union(fragmentIds[edge.U], fragmentIds[edge.V]) {
+			continue
+		}
+		forest = append(forest, edge)
+	}
+
+	return forest
+}
+
+// contracts the edges over the fragments their endpoints belong to: edges within a
+// single fragment are dropped, and only the lightest of parallel edges between two
+// fragments is kept
+func ContractEdges(edges []*Edge, fragmentIds map[int32]int32) []*Edge {
+	type fragmentPair struct{ low, high int32 }
+
+	lightest := make(map[fragmentPair]*Edge)
+	for _, edge := range edges {
+		pair := fragmentPair{fragmentIds[edge.U], fragmentIds[edge.V]}
+		if pair.low == pair.high {
+			continue
+		}
+		if pair.low > pair.high {
+			pair.low, pair.high = pair.high, pair.low
+		}
+
+		if curr, ok := lightest[pair]; !ok || CompareEdges(edge, curr) < 0 {
+			lightest[pair] = edge
+		}
+	}
+
+	contracted := make([]*Edge, 0, len(lightest))
+	for _, edge := range lightest {
+		contracted = append(contracted, edge)
+	}
+	SortEdges(contracted)
+
+	return contracted
+}
@@ -0,0 +1,216 @@
+package utils
+
+import (
+	"cmp"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"slices"
+)
+
+// a strategy to split the edges of the graph between the leaves
+type Partitioner interface {
+	Partition(edges []*Edge, numPartitions int) ([][]*Edge, error)
+}
+
+func NewPartitioner(strategy string, seed int64) (Partitioner, error) {
+	switch strategy {
+	case "contiguous":
+		return &ContiguousPartitioner{}, nil
+	case "shuffle":
+		return &ShufflePartitioner{seed: seed}, nil
+	case "hash":
+		return &HashPartitioner{}, nil
+	case "locality":
+		return &LocalityPartitioner{seed: seed, iterations: 10}, nil
+	}
+	return nil, fmt.Errorf("unknown partition strategy %q, expected contiguous, shuffle, hash or locality", strategy)
+}
+
+// contiguous chunks of the edges, in the order they were read in
+type ContiguousPartitioner struct{}
+
+func (p *ContiguousPartitioner) Partition(edges []*Edge, numPartitions int) ([][]*Edge, error) {
+	return Partition(edges, numPartitions)
+}
+
+// contiguous chunks of a (seeded) random shuffle of the edges
+type ShufflePartitioner struct {
+	seed int64
+}
+
+func (p *ShufflePartitioner) Partition(edges []*Edge, numPartitions int) ([][]*Edge, error) {
+	shuffled := slices.Clone(edges)
+	rng := rand.New(rand.NewSource(p.seed))
+	rng.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+
+	return Partition(shuffled, numPartitions)
+}
+
+// every edge goes to the partition given by the hash of its source vertex, so the
+// edges out of a vertex end up together, unless that partition is full: none holds
+// more than its share of the edges (rounded up), and an edge that does not fit goes
+// on to the next partition with room. Hashing alone leaves the partitions of a
+// skewed graph as skewed, and some of them empty.
+type HashPartitioner struct{}
+
+func (p *HashPartitioner) Partition(edges []*Edge, numPartitions int) ([][]*Edge, error) {
+	if numPartitions < 1 {
+		return nil, fmt.Errorf("number of partitions must be at least 1")
+	}
+
+	capacity := (len(edges) + numPartitions - 1) / numPartitions
+	result := make([][]*Edge, numPartitions)
+	for _, edge := range edges {
+		hasher := fnv.New32a()
+		_, _ = hasher.Write([]byte(fmt.Sprintf("%d", edge.U)))
+		i := int(hasher.Sum32() % uint32(numPartitions))
+		for len(result[i]) >= capacity {
+			i = (i + 1) % numPartitions
+		}
+
+		result[i] = append(result[i], edge)
+	}
+
+	return result, nil
+}
+
+// groups vertices into communities through label propagation, and then cuts the
+// edges, ordered by the community of their endpoints (and then by the endpoints
+// themselves), into balanced chunks
+type LocalityPartitioner struct {
+	seed       int64
+	iterations int
+}
+
+func (p *LocalityPartitioner) Partition(edges []*Edge, numPartitions int) ([][]*Edge, error) {
+	labels := p.propagateLabels(edges)
+
+	ordered := slices.Clone(edges)
+	slices.SortStableFunc(ordered, func(a, b *Edge) int {
+		aLow, aHigh := min(labels[a.U], labels[a.V]), max(labels[a.U], labels[a.V])
+		bLow, bHigh := min(labels[b.U], labels[b.V]), max(labels[b.U], labels[b.V])
+		if aLow != bLow {
+			return cmp.Compare(aLow, bLow)
+		}
+		if aHigh != bHigh {
+			return cmp.Compare(aHigh, bHigh)
+		}
+
+		aU, aV := a.endpoints()
+		bU, bV := b.endpoints()
+		if aU != bU {
+			return cmp.Compare(aU, bU)
+		}
+		return cmp.Compare(aV, bV)
+	})
+
+	return Partition(ordered, numPartitions)
+}
+
+// every vertex repeatedly takes on the most frequent label among its neighbours
+// (the smallest on a tie), until no label changes or the iterations run out
+func (p *LocalityPartitioner) propagateLabels(edges []*Edge) map[int32]int32 {
+	adjacencyList := CreateAdjacencyList(edges)
+
+	labels := make(map[int32]int32)
+	vertices := make([]int32, 0, len(adjacencyList))
+	for vertex := range adjacencyList {
+		labels[vertex] = vertex
+		vertices = append(vertices, vertex)
+	}
+	slices.Sort(vertices)
+
+	rng := rand.New(rand.NewSource(p.seed))
+	for iter := 0; iter < p.iterations; iter++ {
+		rng.Shuffle(len(vertices), func(i, j int) {
+			vertices[i], vertices[j] = vertices[j], vertices[i]
+		})
+
+		changed := false
+		for _, vertex := range vertices {
+			counts := make(map[int32]int)
+			for _, target := range adjacencyList[vertex] {
+				counts[labels[target.v]]++
+			}
+
+			best, bestCount := labels[vertex], 0
+			for label, count := range counts {
+				if count > bestCount || (count == bestCount && label < best) {
+					best, bestCount = label, count
+				}
+			}
+
+			if best != labels[vertex] {
+				labels[vertex] = best
+				changed = true
+			}
+		}
+
+		if !changed {
+			break
+		}
+	}
+
+	return labels
+}
+
+type PartitionStats struct {
+	// vertices whose edges lie in more than one partition
+	CutVertices int
+	// edges with an endpoint that is cut, which the leaf holding them cannot settle
+	// on its own
+	CutEdges int
+	// the average number of partitions a vertex appears in
+	Replication float64
+	// the size of the largest partition over the mean partition size
+	Balance float64
+	// partitions with no edges at all
+	EmptyPartitions int
+}
+
+func GetPartitionStats(partitions [][]*Edge) PartitionStats {
+	stats := PartitionStats{}
+	vertexPartitions := make(map[int32]map[int]bool)
+	numEdges, largest := 0, 0
+	for i, partition := range partitions {
+		for _, edge := range partition {
+			for _, vertex := range []int32{edge.U, edge.V} {
+				if _, ok := vertexPartitions[vertex]; !ok {
+					vertexPartitions[vertex] = make(map[int]bool)
+				}
+				vertexPartitions[vertex][i] = true
+			}
+		}
+		numEdges += len(partition)
+		largest = max(largest, len(partition))
+		if len(partition) == 0 {
+			stats.EmptyPartitions++
+		}
+	}
+
+	if len(vertexPartitions) == 0 || numEdges == 0 {
+		return stats
+	}
+
+	replicas := 0
+	for _, vertexParts := range vertexPartitions {
+		if len(vertexParts) > 1 {
+			stats.CutVertices++
+		}
+		replicas += len(vertexParts)
+	}
+	for _, partition := range partitions {
+		for _, edge := range partition {
+			if len(vertexPartitions[edge.U]) > 1 || len(vertexPartitions[edge.V]) > 1 {
+				stats.CutEdges++
+			}
+		}
+	}
+	stats.Replication = float64(replicas) / float64(len(vertexPartitions))
+	stats.Balance = float64(largest) / (float64(numEdges) / float64(len(partitions)))
+
+	return stats
+}
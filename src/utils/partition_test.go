@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// a square with a diagonal, and an edge apart from it
+func fixedGraph() []*Edge {
+	return []*Edge{
+		NewEdge(0, 1, 4), NewEdge(1, 2, 2), NewEdge(2, 3, 7),
+		NewEdge(3, 0, 1), NewEdge(0, 2, 5), NewEdge(4, 5, 3),
+	}
+}
+
+func randomGraph(n, m int, seed int64) []*Edge {
+	rng := rand.New(rand.NewSource(seed))
+	edges := make([]*Edge, m)
+	for i := range edges {
+		edges[i] = NewEdge(rng.Int31n(int32(n)), rng.Int31n(int32(n)), rng.Int31n(100))
+	}
+	return edges
+}
+
+// every edge is in exactly one of the partitions
+func checkPartitions(t *testing.T, edges []*Edge, partitions [][]*Edge, numPartitions int) {
+	t.Helper()
+	if len(partitions) != numPartitions {
+		t.Fatalf("got %d partitions, expected %d", len(partitions), numPartitions)
+	}
+
+	seen := make(map[*Edge]int)
+	for _, partition := range partitions {
+		for _, edge := range partition {
+			seen[edge]++
+		}
+	}
+	for i, edge := range edges {
+		if seen[edge] != 1 {
+			t.Fatalf("edge %d is in %d partitions", i, seen[edge])
+		}
+	}
+	if len(seen) != len(edges) {
+		t.Fatalf("got %d edges in the partitions, expected %d", len(seen), len(edges))
+	}
+}
+
+func TestPartitioners(t *testing.T) {
+	for _, strategy := range []string{"contiguous", "shuffle", "hash", "locality"} {
+		t.Run(strategy, func(t *testing.T) {
+			partitioner, err := NewPartitioner(strategy, 42)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, numPartitions := range []int{1, 3, 6} {
+				edges := fixedGraph()
+				partitions, err := partitioner.Partition(edges, numPartitions)
+				if err != nil {
+					t.Fatalf("%d partitions: %v", numPartitions, err)
+				}
+				checkPartitions(t, edges, partitions, numPartitions)
+			}
+
+			edges := randomGraph(50, 400, 1)
+			partitions, err := partitioner.Partition(edges, 7)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkPartitions(t, edges, partitions, 7)
+
+			// the edges are balanced between the partitions, none of them left empty
+			stats := GetPartitionStats(partitions)
+			if stats.EmptyPartitions != 0 || stats.Balance > 58.0/(400.0/7) {
+				t.Fatalf("got %d empty partitions and a balance of %.2f, expected them balanced", stats.EmptyPartitions, stats.Balance)
+			}
+		})
+	}
+
+	if _, err := NewPartitioner("random", 42); err == nil {
+		t.Fatal("expected an unknown strategy to be turned down")
+	}
+}
+
+// hashing alone would put every edge of a star in a single partition
+func TestHashPartitionerSkew(t *testing.T) {
+	edges := []*Edge{}
+	for v := int32(1); v <= 20; v++ {
+		edges = append(edges, NewEdge(0, v, v))
+	}
+
+	partitions, err := (&HashPartitioner{}).Partition(edges, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPartitions(t, edges, partitions, 4)
+	for i, partition := range partitions {
+		if len(partition) != 5 {
+			t.Fatalf("partition %d holds %d edges, expected 5", i, len(partition))
+		}
+	}
+}
+
+func TestGetPartitionStats(t *testing.T) {
+	edges := fixedGraph()
+	partitions, err := (&ContiguousPartitioner{}).Partition(edges, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 0, 2 and 3 are in both halves, and only the edge apart from the square is not cut
+	got := GetPartitionStats(partitions)
+	expected := PartitionStats{CutVertices: 3, CutEdges: 5, Replication: 1.5, Balance: 1}
+	if got != expected {
+		t.Fatalf("got %+v, expected %+v", got, expected)
+	}
+
+	// a partition of four edges and two empty ones
+	got = GetPartitionStats([][]*Edge{edges[:4], {}, {}})
+	expected = PartitionStats{CutVertices: 0, CutEdges: 0, Replication: 1, Balance: 3, EmptyPartitions: 2}
+	if got != expected {
+		t.Fatalf("got %+v, expected %+v", got, expected)
+	}
+
+	if got := GetPartitionStats(nil); got != (PartitionStats{}) {
+		t.Fatalf("got %+v, expected no stats of no partitions", got)
+	}
+}
@@ -0,0 +1,66 @@
+package utils
+
+// a union-find structure over (sparse) fragment ids, with path compression
+// and union by size
+type DisjointSet struct {
+	parent map[int32]int32
+	size   map[int32]int
+}
+
+func NewDisjointSet() *DisjointSet {
+	return &DisjointSet{
+		parent: make(map[int32]int32),
+		size:   make(map[int32]int),
+	}
+}
+
+func (ds *DisjointSet) Find(v int32) int32 {
+	if _, ok := ds.parent[v]; !ok {
+		ds.parent[v] = v
+		ds.size[v] = 1
+	}
+
+	root := v
+	for ds.parent[root] != root {
+		root = ds.parent[root]
+	}
+
+	// path compression
+	for ds.parent[v] != root {
+		next := ds.parent[v]
+		ds.parent[v] = root
+		v = next
+	}
+
+	return root
+}
+
+// merges the sets containing u and v, returning false if they were already
+// in the same set. On a tie in size, the representative of v is kept.
+func (ds *DisjointSet) Union(u, v int32) bool {
+	rootU, rootV := ds.Find(u), ds.Find(v)
+	if rootU == rootV {
+		return false
+	}
+
+	if ds.size[rootU] > ds.size[rootV] {
+		rootU, rootV = rootV, rootU
+	}
+	ds.parent[rootU] = rootV
+	ds.size[rootV] += ds.size[rootU]
+
+	return true
+}
+
+// maps every element that is not its own representative directly onto its
+// representative, so that the map can be applied in a single pass
+func (ds *DisjointSet) Flatten() map[int32]int32 {
+	flat := make(map[int32]int32)
+	for v := range ds.parent {
+		if root := ds.Find(v); root != v {
+			flat[v] = root
+		}
+	}
+
+	return flat
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// exit code of a run the watchdog found stuck, apart from that of any other failure
+const exitStalled = 3
+
+// notices when no node progresses its phase for a while, and takes the process down
+// with a dump of the state of every node
+type Watchdog struct {
+	// the nodes to watch, which may change as standbys take over
+	nodes      func() []*NodeData
+	stallAfter time.Duration
+	dumpFile   string
+}
+
+func NewWatchdog(nodes func() []*NodeData, stallAfter time.Duration, dumpFile string) *Watchdog {
+	return &Watchdog{nodes: nodes, stallAfter: stallAfter, dumpFile: dumpFile}
+}
+
+// watches the nodes in the background, if stallAfter is set, until stopped
+func startWatchdog(nodes func() []*NodeData, stallAfter time.Duration, dumpFile string) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if stallAfter > 0 {
+		go NewWatchdog(nodes, stallAfter, dumpFile).Run(ctx)
+	}
+	return cancel
+}
+
+// watches the nodes until ctx is done, or exits the process if they stall
+func (w *Watchdog) Run(ctx context.Context) {
+	ticker := time.NewTicker(max(w.stallAfter/10, 10*time.Millisecond))
+	defer ticker.Stop()
+
+	phases := make(map[*NodeData]int32)
+	lastProgress := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		if w.progressed(phases) {
+			lastProgress = now
+			continue
+		}
+		stalled := now.Sub(lastProgress)
+		if stalled < w.stallAfter {
+			continue
+		}
+
+		log.Printf("[ERROR] no node progressed its phase for %v, dumping the state of the nodes to %s", stalled.Round(time.Millisecond), w.dumpFile)
+		if err := w.dump(stalled); err != nil {
+			log.Printf("[ERROR] failed to write the watchdog dump: %v", err)
+		}
+		os.Exit(exitStalled)
+	}
+}
+
+// notes the phase of every node, and says whether any moved on since the last look.
+// A node busy with its state is looked at next time.
+func (w *Watchdog) progressed(phases map[*NodeData]int32) bool {
+	progressed := false
+	for _, node := range w.nodes() {
+		if !node.md.stateMutex.TryLock() {
+			continue
+		}
+		phase := node.md.phase
+		node.md.stateMutex.Unlock()
+
+		if last, ok := phases[node]; !ok || phase > last {
+			phases[node] = phase
+			progressed = true
+		}
+	}
+	return progressed
+}
+
+// writes the state of every node, then the stacks of every goroutine
+func (w *Watchdog) dump(stalled time.Duration) error {
+	file, err := os.Create(w.dumpFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fmt.Fprintf(file, "no node progressed its phase for %v, as of %s\n\n", stalled.Round(time.Millisecond), time.Now().Format(time.RFC3339))
+	fmt.Fprintf(file, "nodes:\n")
+	for _, node := range w.nodes() {
+		fmt.Fprintf(file, "  %s\n", describeNode(node))
+	}
+
+	fmt.Fprintf(file, "\ngoroutines:\n")
+	return pprof.Lookup("goroutine").WriteTo(file, 2)
+}
+
+// the state of a node for the dump. A stuck node may hold any of its locks for good,
+// so each is only tried, and whatever it guards is left out if it is held.
+func describeNode(node *NodeData) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "node %d:", node.md.id)
+
+	children := []int32{}
+	phase := int32(-1)
+	withLock(&node.md.stateMutex, func() {
+		phase = node.md.phase
+		parent := "nil"
+		if node.md.parent != nil {
+			parent = fmt.Sprintf("%d", node.md.parent.id)
+		}
+		for _, child := range node.md.children {
+			children = append(children, child.id)
+		}
+		fmt.Fprintf(&sb, " phase %d, parent %s, children %v,", phase, parent, children)
+	}, &sb, "state")
+
+	withLock(&node.barrier.mutex, func() {
+		pending := []int32{}
+		arrived := node.barrier.arrived[node.barrier.published+1]
+		for _, child := range children {
+			if !arrived[child] {
+				pending = append(pending, child)
+			}
+		}
+		slices.Sort(pending)
+		fmt.Fprintf(&sb, " pending children %v, barrier %s,", pending, node.barrier.describe())
+	}, &sb, "barrier")
+
+	withLock(&node.edgesMutex, func() {
+		fmt.Fprintf(&sb, " edges %d (%d spilled),", len(node.edges)+node.numSpilled, node.numSpilled)
+	}, &sb, "edges")
+
+	withLock(&node.fragmentsMutex, func() {
+		fmt.Fprintf(&sb, " fragments %d", len(node.fragments))
+	}, &sb, "fragments")
+
+	return strings.TrimSuffix(sb.String(), ",")
+}
+
+// runs f with mutex held, or notes in sb that what it guards is locked
+func withLock(mutex *sync.Mutex, f func(), sb *strings.Builder, what string) {
+	if !mutex.TryLock() {
+		fmt.Fprintf(sb, " %s locked,", what)
+		return
+	}
+	defer mutex.Unlock()
+
+	f()
+}
+
+// the dump file of a single node, next to that of the others
+func nodeDumpFile(dumpFile string, id int32) string {
+	ext := filepath.Ext(dumpFile)
+	return fmt.Sprintf("%s-node-%d%s", strings.TrimSuffix(dumpFile, ext), id, ext)
+}
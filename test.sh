@@ -10,6 +10,6 @@ sleep 10
 
 echo && echo "getting distributed mst results"
 cd src || exit
-go run ./*.go ../data/graph.txt out.txt 0.5
+go run ./*.go -budget-policy report ../data/graph.txt out.txt 0.5
 [ -f out.txt ] && rm out.txt
 cd - || exit